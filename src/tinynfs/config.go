@@ -18,18 +18,42 @@ type Network struct {
 	ImageOtimizeSize    int
 	ImageOtimizeSide    int
 	ImageThumbnailSizes map[string]bool
+	S3Bind              string
+	S3Region            string
+	S3Credentials       map[string]string
+	WebDAVBind          string
+	AuthKeys            map[string]*AuthKey
+	AuthPrivates        []string
+}
+
+type AuthKey struct {
+	Key        string
+	Secret     string
+	Operations map[string]bool
+	Prefixes   []string
 }
 
 type VolumeGroup struct {
-	Id   int
-	Path string
+	Id     int
+	Path   string
+	Weight int
 }
 
 type Storage struct {
+	ReadOnly         bool
 	DiskRemain       int64
 	SnapshotInterval int64
 	SnapshotReserve  int
+	CompactInterval  int64
+	CompactThreshold int
+	UploadExpire     int64
+	TrashRetention   int64
+	VersionMax       int
+	ScrubInterval    int64
+	ScrubRate        int64
 	VolumeSliceSize  int64
+	VolumeReplicas   int
+	VolumePolicy     string
 	VolumeFileGroups []VolumeGroup
 }
 
@@ -53,12 +77,38 @@ func (self *Config) Dump() string {
 	lines = append(lines, fmt.Sprintf("network.image.optimize.size=%d #Bytes", self.Network.ImageOtimizeSize))
 	lines = append(lines, fmt.Sprintf("network.image.optimize.side=%d", self.Network.ImageOtimizeSide))
 	lines = append(lines, "network.image.thumbnail.sizes="+strings.Join(sizes, ","))
+	lines = append(lines, "network.s3.bind="+self.Network.S3Bind)
+	lines = append(lines, "network.s3.region="+self.Network.S3Region)
+	keys := make([]string, 0, len(self.Network.S3Credentials))
+	for k := range self.Network.S3Credentials {
+		keys = append(keys, k+":******")
+	}
+	lines = append(lines, "network.s3.credentials="+strings.Join(keys, ","))
+	lines = append(lines, "network.webdav.bind="+self.Network.WebDAVBind)
+	for _, v := range self.Network.AuthKeys {
+		ops := make([]string, 0, len(v.Operations))
+		for k := range v.Operations {
+			ops = append(ops, k)
+		}
+		lines = append(lines, "network.auth.key="+v.Key+":******:"+strings.Join(ops, ",")+":"+strings.Join(v.Prefixes, ","))
+	}
+	lines = append(lines, "network.auth.private="+strings.Join(self.Network.AuthPrivates, ","))
+	lines = append(lines, fmt.Sprintf("storage.readonly=%t", self.Storage.ReadOnly))
 	lines = append(lines, fmt.Sprintf("storage.disk.remain=%d #Bytes", self.Storage.DiskRemain))
 	lines = append(lines, fmt.Sprintf("storage.snapshot.interval=%d #Seconds", self.Storage.SnapshotInterval))
 	lines = append(lines, fmt.Sprintf("storage.snapshot.reserve=%d", self.Storage.SnapshotReserve))
+	lines = append(lines, fmt.Sprintf("storage.compact.interval=%d #Seconds", self.Storage.CompactInterval))
+	lines = append(lines, fmt.Sprintf("storage.compact.threshold=%d #Percent", self.Storage.CompactThreshold))
+	lines = append(lines, fmt.Sprintf("storage.upload.expire=%d #Seconds", self.Storage.UploadExpire))
+	lines = append(lines, fmt.Sprintf("storage.trash.retention=%d #Seconds", self.Storage.TrashRetention))
+	lines = append(lines, fmt.Sprintf("storage.version.max=%d", self.Storage.VersionMax))
+	lines = append(lines, fmt.Sprintf("storage.scrub.interval=%d #Seconds", self.Storage.ScrubInterval))
+	lines = append(lines, fmt.Sprintf("storage.scrub.rate=%d #Bytes", self.Storage.ScrubRate))
 	lines = append(lines, fmt.Sprintf("storage.volume.slicesize=%d #Bytes", self.Storage.VolumeSliceSize))
+	lines = append(lines, fmt.Sprintf("storage.volume.replicas=%d", self.Storage.VolumeReplicas))
+	lines = append(lines, "storage.volume.policy="+self.Storage.VolumePolicy)
 	for _, v := range self.Storage.VolumeFileGroups {
-		lines = append(lines, fmt.Sprintf("storage.volume.filegroups=%d:%s", v.Id, v.Path))
+		lines = append(lines, fmt.Sprintf("storage.volume.filegroups=%d:%s:%d", v.Id, v.Path, v.weight()))
 	}
 	return strings.Join(lines, "\n")
 }
@@ -109,16 +159,27 @@ func NewConfig(filepath string) (*Config, error) {
 			ImageOtimizeSize:    350 * 1024,
 			ImageOtimizeSide:    2048,
 			ImageThumbnailSizes: map[string]bool{},
+			S3Region:            "us-east-1",
+			S3Credentials:       map[string]string{},
+			AuthKeys:            map[string]*AuthKey{},
 		},
 		Storage: &Storage{
 			DiskRemain:       100 * 1024 * 1024,
 			SnapshotInterval: 1800,
 			SnapshotReserve:  2,
+			CompactInterval:  3600,
+			CompactThreshold: 50,
+			UploadExpire:     86400,
+			ScrubInterval:    604800,
+			ScrubRate:        4 * 1024 * 1024,
 			VolumeSliceSize:  5 * 1024 * 1024 * 1024,
+			VolumeReplicas:   1,
+			VolumePolicy:     VolumePolicyFirst,
 			VolumeFileGroups: []VolumeGroup{
 				VolumeGroup{
-					Id:   0,
-					Path: "{{DATA}}/volumes/",
+					Id:     0,
+					Path:   "{{DATA}}/volumes/",
+					Weight: 1,
 				},
 			},
 		},
@@ -199,6 +260,63 @@ func NewConfig(filepath string) (*Config, error) {
 					}
 				}
 			}
+		case "network.s3.bind":
+			if m, _ := regexp.MatchString("^[:0-9a-zA-Z]*:[0-9]+$", value); !m {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Network.S3Bind = value
+			}
+		case "network.s3.region":
+			if m, _ := regexp.MatchString("^[0-9a-z-]+$", value); !m {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Network.S3Region = value
+			}
+		case "network.s3.credentials":
+			if m, _ := regexp.MatchString("^[0-9a-zA-Z]+:[^:,]+(,[0-9a-zA-Z]+:[^:,]+)*$", value); !m {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Network.S3Credentials = map[string]string{}
+				for _, v := range strings.Split(value, ",") {
+					fields := strings.SplitN(v, ":", 2)
+					config.Network.S3Credentials[fields[0]] = fields[1]
+				}
+			}
+		case "network.webdav.bind":
+			if m, _ := regexp.MatchString("^[:0-9a-zA-Z]*:[0-9]+$", value); !m {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Network.WebDAVBind = value
+			}
+		case "network.auth.key":
+			if m, _ := regexp.MatchString("^[0-9a-zA-Z_-]+:[^:]+:(read|write|delete|admin)(,(read|write|delete|admin))*:\\/[^:,]*(,\\/[^:,]*)*$", value); !m {
+				return nil, fmt.Errorf("line %d: %s", no, ErrParam)
+			} else {
+				fields := strings.Split(value, ":")
+				akey := &AuthKey{
+					Key:        fields[0],
+					Secret:     fields[1],
+					Operations: map[string]bool{},
+					Prefixes:   strings.Split(fields[3], ","),
+				}
+				for _, v := range strings.Split(fields[2], ",") {
+					akey.Operations[v] = true
+				}
+				config.Network.AuthKeys[akey.Key] = akey
+			}
+		case "network.auth.private":
+			if m, _ := regexp.MatchString("^\\/[^:,]*(,\\/[^:,]*)*$", value); !m {
+				return nil, fmt.Errorf("line %d: %s", no, ErrParam)
+			} else {
+				config.Network.AuthPrivates = strings.Split(value, ",")
+			}
+		case "storage.readonly":
+			readOnly, err := strconv.ParseBool(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", no, ErrParam)
+			} else {
+				config.Storage.ReadOnly = readOnly
+			}
 		case "storage.disk.remain":
 			size, err := parseBytes(value)
 			if err != nil {
@@ -220,6 +338,55 @@ func NewConfig(filepath string) (*Config, error) {
 			} else {
 				config.Storage.SnapshotReserve = int(count)
 			}
+		case "storage.compact.interval":
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Storage.CompactInterval = int64(count)
+			}
+		case "storage.compact.threshold":
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || count > 100 {
+				return nil, fmt.Errorf("line %d: %s", no, ErrParam)
+			} else {
+				config.Storage.CompactThreshold = int(count)
+			}
+		case "storage.upload.expire":
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Storage.UploadExpire = int64(count)
+			}
+		case "storage.trash.retention":
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Storage.TrashRetention = int64(count)
+			}
+		case "storage.version.max":
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Storage.VersionMax = int(count)
+			}
+		case "storage.scrub.interval":
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Storage.ScrubInterval = int64(count)
+			}
+		case "storage.scrub.rate":
+			size, err := parseBytes(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", no, err)
+			} else {
+				config.Storage.ScrubRate = int64(size)
+			}
 		case "storage.volume.slicesize":
 			size, err := parseBytes(value)
 			if err != nil {
@@ -227,15 +394,39 @@ func NewConfig(filepath string) (*Config, error) {
 			} else {
 				config.Storage.VolumeSliceSize = int64(size)
 			}
+		case "storage.volume.replicas":
+			count, err := strconv.ParseUint(value, 10, 32)
+			if err != nil || count < 1 {
+				return nil, fmt.Errorf("line %d: %s", no, ErrParam)
+			} else {
+				config.Storage.VolumeReplicas = int(count)
+			}
+		case "storage.volume.policy":
+			if !volumePolicies[value] {
+				return nil, fmt.Errorf("line %d: %s", no, ErrParam)
+			} else {
+				config.Storage.VolumePolicy = value
+			}
 		case "storage.volume.filegroups":
-			if m, _ := regexp.MatchString("^[0-9]{1,2}:\\/.*\\/+$", value); !m {
+			// The weight is optional after the path, default 1
+			if m, _ := regexp.MatchString("^[0-9]{1,2}:\\/.*\\/+(:[0-9]+)?$", value); !m {
 				return nil, fmt.Errorf("line %d: %s", no, err)
 			} else {
-				fields := strings.Split(value, ":")
-				id, _ := strconv.ParseUint(fields[0], 10, 32)
+				i, j := strings.Index(value, ":"), strings.LastIndex(value, "/")
+				id, _ := strconv.ParseUint(value[:i], 10, 32)
+				weight := uint64(1)
+				if j+1 < len(value) {
+					if weight, err = strconv.ParseUint(value[j+2:], 10, 32); err != nil {
+						return nil, fmt.Errorf("line %d: %s", no, err)
+					}
+					if weight < 1 {
+						return nil, fmt.Errorf("line %d: %s", no, ErrParam)
+					}
+				}
 				vfgs = append(vfgs, VolumeGroup{
-					Id:   int(id),
-					Path: fields[1],
+					Id:     int(id),
+					Path:   value[i+1 : j+1],
+					Weight: int(weight),
 				})
 			}
 		default:
@@ -248,6 +439,10 @@ func NewConfig(filepath string) (*Config, error) {
 	if len(vfgs) > 0 {
 		config.Storage.VolumeFileGroups = vfgs
 	}
+	// Every replica is written to the different volume group
+	if config.Storage.VolumeReplicas > len(config.Storage.VolumeFileGroups) {
+		return nil, fmt.Errorf("storage.volume.replicas: %s", ErrParam)
+	}
 
 	return config, nil
 }
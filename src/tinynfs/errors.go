@@ -11,15 +11,22 @@ var (
 	ErrNotExist   = os.ErrNotExist
 	ErrPermission = os.ErrPermission
 
-	ErrParam         = errors.New("bad parameters")
-	ErrTimestamp     = errors.New("unacceptable timestamp")
-	ErrMediaType     = errors.New("unsupported media type")
-	ErrThumbnailSize = errors.New("unacceptable thumbnail size")
+	ErrParam          = errors.New("bad parameters")
+	ErrTimestamp      = errors.New("unacceptable timestamp")
+	ErrMediaType      = errors.New("unsupported media type")
+	ErrThumbnailSize  = errors.New("unacceptable thumbnail size")
+	ErrUploadConflict = errors.New("upload session conflict")
 
 	ErrIndexStorageBusy   = errors.New("index storage already lock")
 	ErrIndexStorageFully  = errors.New("index storage disk space fully")
 	ErrVolumeStorageBusy  = errors.New("volume storage already lock")
 	ErrVolumeStorageFully = errors.New("volume storage disk space fully")
+	ErrVolumeVersion      = errors.New("unsupported volume version")
+	ErrVolumeRecord       = errors.New("volume record corrupted")
+	ErrVolumeData         = errors.New("volume data corrupted")
+	ErrScrubBusy          = errors.New("volume scrub already running")
+	ErrDrainBusy          = errors.New("volume drain already running")
+	ErrReadOnly           = errors.New("storage is read-only")
 )
 
 var (
@@ -30,16 +37,25 @@ var (
 		ErrNotExist:           104,
 		ErrMediaType:          105,
 		ErrThumbnailSize:      106,
+		ErrUploadConflict:     107,
 		ErrIndexStorageFully:  201,
 		ErrVolumeStorageFully: 202,
+		ErrVolumeData:         203,
+		ErrScrubBusy:          204,
+		ErrDrainBusy:          205,
+		ErrReadOnly:           206,
 	}
 	httpStatusCodes = map[error]int{
-		ErrParam:         http.StatusBadRequest,
-		ErrPermission:    http.StatusForbidden,
-		ErrExist:         http.StatusForbidden,
-		ErrNotExist:      http.StatusNotFound,
-		ErrMediaType:     http.StatusUnsupportedMediaType,
-		ErrThumbnailSize: http.StatusBadRequest,
+		ErrParam:          http.StatusBadRequest,
+		ErrPermission:     http.StatusForbidden,
+		ErrExist:          http.StatusForbidden,
+		ErrNotExist:       http.StatusNotFound,
+		ErrMediaType:      http.StatusUnsupportedMediaType,
+		ErrThumbnailSize:  http.StatusBadRequest,
+		ErrUploadConflict: http.StatusConflict,
+		ErrScrubBusy:      http.StatusConflict,
+		ErrDrainBusy:      http.StatusConflict,
+		ErrReadOnly:       http.StatusServiceUnavailable,
 	}
 )
 
@@ -1,17 +1,24 @@
 package tinynfs
 
 import (
+	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	bolt "github.com/etcd-io/bbolt"
+	"hash"
+	"io"
 	"io/ioutil"
+	"log"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,6 +33,78 @@ type FileNode struct {
 	HashNode
 	Mime     string `json:"mime"`
 	Metadata string `json:"metadata"`
+	Hash     string `json:"hash,omitempty"`
+	Created  int64  `json:"created,omitempty"`
+	Expires  int64  `json:"expires,omitempty"`
+	Deleted  int64  `json:"deleted,omitempty"`
+	Version  int64  `json:"version,omitempty"`
+	Filename string `json:"filename,omitempty"`
+
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+func makeVolumeRecord(kind byte, filepath string, fnode *FileNode) *VolumeRecord {
+	record := &VolumeRecord{
+		Kind:     kind,
+		FilePath: filepath,
+	}
+	if fnode != nil {
+		// Save the file node without location, for index rebuilding
+		xnode := *fnode
+		xnode.HashNode = HashNode{}
+		record.Hash = fnode.hashKey()
+		record.Mime = fnode.Mime
+		record.Extra, _ = json.Marshal(&xnode)
+	}
+	return record
+}
+
+func (self *FileNode) hashKey() []byte {
+	hashkey, err := hex.DecodeString(self.Hash)
+	if err != nil || len(hashkey) != sha256.Size {
+		return nil
+	}
+	return hashkey
+}
+
+func (self *FileNode) isExpired() bool {
+	return self.Expires > 0 && self.Expires <= time.Now().Unix()
+}
+
+type FileReader struct {
+	*VolumeReader
+	Node *FileNode
+
+	// The checksum of reading from the start, verified at the end
+	hash      hash.Hash
+	hashed    int64
+	corrupted bool
+	onCorrupt func()
+}
+
+func (self *FileReader) Read(p []byte) (int, error) {
+	if self.hash == nil {
+		return self.VolumeReader.Read(p)
+	}
+	offset, _ := self.Seek(0, io.SeekCurrent)
+	n, err := self.VolumeReader.Read(p)
+	if offset != self.hashed {
+		// Random access, the data is not verified
+		self.hash = nil
+		return n, err
+	}
+	self.hash.Write(p[:n])
+	self.hashed += int64(n)
+	if self.hashed == self.Size() && !isSameHash(self.Node.hashKey(), self.hash.Sum(nil)) {
+		// The last data is not returned
+		self.hash = nil
+		self.corrupted = true
+		if self.onCorrupt != nil {
+			self.onCorrupt()
+		}
+		return 0, ErrVolumeData
+	}
+	return n, err
 }
 
 type FileSystem struct {
@@ -34,20 +113,50 @@ type FileSystem struct {
 	storageDB      *bolt.DB
 	timeOnUpdate   int64
 	timeOnSnapshot int64
+	timeOnCompact  int64
+	timeOnScrub    int64
+	readOnly       int32
+	writeLock      sync.RWMutex
+	compactLock    sync.Mutex
+	uploadLock     sync.Mutex
+	uploading      map[string]bool
+	scrubLock      sync.Mutex
+	scrubbing      bool
+	scrubResult    *ScrubResult
+	placeLock      sync.Mutex
+	placeNext      int
+	placeCurrents  map[int]int
+	draining       map[int]bool
+	drainLock      sync.Mutex
+	drainRunning   map[int]bool
+	drainResults   map[int]*DrainResult
 	volumeGroupIds []int
 	volumeStorages map[int]*VolumeStorage
 }
 
 type WriteOptions struct {
 	Overwrite bool
+	Expires   int64             // The unix time to expire, 0 never
+	Meta      map[string]string // The user metadata
+	Filename  string            // The original filename
 }
 
 var (
 	fileBucket          = []byte("files")
 	hashBucket          = []byte("hashs")
+	refsBucket          = []byte("refs")
+	expireBucket        = []byte("expires")
+	trashBucket         = []byte("trash")
+	versionBucket       = []byte("versions")
+	corruptBucket       = []byte("corrupts")
+	replicaBucket       = []byte("replicas")
+	drainBucket         = []byte("drains")
 	defaultWriteOptions = &WriteOptions{
 		Overwrite: true,
 	}
+
+	// The buckets of file nodes, the data of them is alive
+	nodeBuckets = [][]byte{fileBucket, trashBucket, versionBucket}
 )
 
 func (self *FileSystem) init() error {
@@ -71,6 +180,11 @@ func (self *FileSystem) init() error {
 		self.volumeStorages[v.Id] = vs
 		self.volumeGroupIds = append(self.volumeGroupIds, v.Id)
 	}
+	// Clean the temporary files of last process
+	tmppath := filepath.Join(self.root, "tmp")
+	os.RemoveAll(tmppath)
+	os.MkdirAll(tmppath, 0777)
+	os.MkdirAll(filepath.Join(self.root, "uploads"), 0777)
 	self.storageDB = db
 	self.storageDB.Update(func(tx *bolt.Tx) error {
 		_, err := tx.CreateBucketIfNotExists(fileBucket)
@@ -86,6 +200,69 @@ func (self *FileSystem) init() error {
 		}
 		return nil
 	})
+	self.storageDB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(expireBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+	self.storageDB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(trashBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+	self.storageDB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(versionBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+	self.storageDB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(corruptBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+	self.storageDB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(replicaBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+	self.storageDB.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(drainBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		return nil
+	})
+	if err := self.loadDraining(); err != nil {
+		log.Println(fmt.Sprintf("load draining failed %s", err))
+	}
+	repair := false
+	self.storageDB.Update(func(tx *bolt.Tx) error {
+		if tx.Bucket(refsBucket) != nil {
+			return nil
+		}
+		_, err := tx.CreateBucket(refsBucket)
+		if err != nil {
+			return fmt.Errorf("create bucket: %s", err)
+		}
+		repair = true
+		return nil
+	})
+	// Count the references of storage created by old version
+	if repair {
+		if _, err := self.RepairRefs(); err != nil {
+			log.Println(fmt.Sprintf("repair refs failed %s", err))
+		}
+	}
 	return nil
 }
 
@@ -98,52 +275,190 @@ func (self *FileSystem) Close() {
 	}
 }
 
+func (self *FileSystem) txReadNode(tx *bolt.Tx, bucket []byte, key []byte, node interface{}) error {
+	bt := tx.Bucket(bucket)
+	v := bt.Get(key)
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(v, node)
+}
+
+func (self *FileSystem) txWriteNode(tx *bolt.Tx, bucket []byte, key []byte, node interface{}) error {
+	bt := tx.Bucket(bucket)
+	b, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	return bt.Put(key, b)
+}
+
 func (self *FileSystem) readNode(bucket []byte, key []byte, node interface{}) error {
 	return self.storageDB.View(func(tx *bolt.Tx) error {
-		bt := tx.Bucket(bucket)
-		v := bt.Get(key)
-		if v == nil {
-			return nil
-		}
-		return json.Unmarshal(v, node)
+		return self.txReadNode(tx, bucket, key, node)
 	})
 }
 
-func (self *FileSystem) writeNode(bucket []byte, key []byte, node interface{}) error {
-	return self.storageDB.Update(func(tx *bolt.Tx) error {
-		bt := tx.Bucket(bucket)
-		b, err := json.Marshal(node)
-		if err != nil {
-			return err
-		}
-		return bt.Put(key, b)
-	})
+func (self *FileSystem) createTempFile(prefix string) (*os.File, error) {
+	return ioutil.TempFile(filepath.Join(self.root, "tmp"), prefix)
 }
 
-func (self *FileSystem) ReadFile(filepath string) (string, string, []byte, error) {
+func (self *FileSystem) selectVolumeStorage(filepath string) (int, *VolumeStorage) {
+	return self.placeVolumeGroup(filepath, nil)
+}
+
+func (self *FileSystem) writeRecord(kind byte, filepath string, fnode *FileNode) error {
+	_, volumeStorage := self.selectVolumeStorage(filepath)
+	if volumeStorage == nil {
+		return ErrVolumeStorageFully
+	}
+	_, _, err := volumeStorage.WriteFile(nil, makeVolumeRecord(kind, filepath, fnode))
+	return err
+}
+
+func (self *FileSystem) Stat(filepath string) (*FileNode, error) {
 	var fnode *FileNode
 	if err := self.readNode(fileBucket, []byte(filepath), &fnode); err != nil {
-		return "", "", nil, err
+		return nil, err
 	}
-	if fnode == nil {
-		return "", "", nil, ErrNotExist
+	if fnode == nil || fnode.isExpired() {
+		return nil, ErrNotExist
 	}
-	volumeStorage := self.volumeStorages[fnode.GroupId]
-	if volumeStorage == nil {
-		return "", "", nil, ErrNotExist
+	return fnode, nil
+}
+
+func (self *FileSystem) OpenFile(filepath string) (*FileReader, error) {
+	return self.openNode(func() (*FileNode, error) {
+		return self.Stat(filepath)
+	})
+}
+
+// The file is opened from the first readable replica
+func (self *FileSystem) openNode(stat func() (*FileNode, error)) (*FileReader, error) {
+	for retry := 0; ; retry++ {
+		fnode, err := stat()
+		if err != nil {
+			return nil, err
+		}
+		hashkey := fnode.hashKey()
+		corrupted := false
+		for _, location := range self.readLocations(hashkey, &fnode.HashNode) {
+			if self.isCorrupted(hashkey, &location) {
+				corrupted = true
+				continue
+			}
+			volumeStorage := self.volumeStorages[location.GroupId]
+			if volumeStorage == nil {
+				continue
+			}
+			reader, err := volumeStorage.OpenFile(location.VolumeId, location.VolumeOffset, location.Size)
+			if err != nil {
+				continue
+			}
+			node := *fnode
+			node.HashNode = location
+			file := &FileReader{VolumeReader: reader, Node: &node}
+			if hashkey != nil {
+				file.hash = sha256.New()
+				file.onCorrupt = func() {
+					self.quarantine(hashkey, &node.HashNode)
+				}
+			}
+			return file, nil
+		}
+		// The volume maybe removed by compaction, reload the node
+		if retry < 1 {
+			continue
+		}
+		if corrupted {
+			return nil, ErrVolumeData
+		}
+		return nil, ErrNotExist
 	}
-	data, err := volumeStorage.ReadFile(fnode.VolumeId, fnode.VolumeOffset, fnode.Size)
-	if err != nil {
-		return "", "", nil, ErrNotExist
+}
+
+func (self *FileSystem) ReadFile(filepath string) (string, string, []byte, error) {
+	for retry := 0; ; retry++ {
+		file, err := self.OpenFile(filepath)
+		if err != nil {
+			return "", "", nil, err
+		}
+		data := make([]byte, file.Size())
+		_, err = io.ReadFull(file, data)
+		file.Close()
+		if err == ErrVolumeData && retry < len(self.volumeGroupIds) {
+			// The corrupted replica was quarantined, read the other
+			continue
+		} else if err == ErrVolumeData {
+			return "", "", nil, err
+		} else if err != nil {
+			return "", "", nil, ErrNotExist
+		}
+		return file.Node.Mime, file.Node.Metadata, data, nil
 	}
-	return fnode.Mime, fnode.Metadata, data, nil
 }
 
 func (self *FileSystem) WriteFile(filepath string, filemime string, metadata string, data []byte, options *WriteOptions) error {
+	hashkey := sha256.Sum256(data)
+	return self.writeFile(filepath, filemime, metadata, hashkey[:], int64(len(data)), bytes.NewReader(data), options)
+}
+
+func (self *FileSystem) WriteStream(filepath string, filemime string, metadata string, reader io.Reader, options *WriteOptions) (int64, error) {
 	if options == nil {
 		options = defaultWriteOptions
 	}
+	if err := self.checkWritable(filepath, options); err != nil {
+		return 0, err
+	}
+
+	// Save to temporary file, the sha256 was required before writing volume
+	tmpfile, err := self.createTempFile("stream-")
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		tmpfile.Close()
+		os.Remove(tmpfile.Name())
+	}()
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmpfile, hash), reader)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmpfile.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := self.writeFile(filepath, filemime, metadata, hash.Sum(nil), size, tmpfile, options); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+// SetReadOnly refuses or accepts the writes at runtime, the reads are
+// served always.
+func (self *FileSystem) SetReadOnly(readOnly bool) {
+	if readOnly {
+		atomic.StoreInt32(&self.readOnly, 1)
+	} else {
+		atomic.StoreInt32(&self.readOnly, 0)
+	}
+}
+
+func (self *FileSystem) IsReadOnly() bool {
+	return atomic.LoadInt32(&self.readOnly) != 0
+}
+
+func (self *FileSystem) checkReadOnly() error {
+	if self.IsReadOnly() {
+		return ErrReadOnly
+	}
+	return nil
+}
 
+func (self *FileSystem) checkWritable(filepath string, options *WriteOptions) error {
+	if err := self.checkReadOnly(); err != nil {
+		return err
+	}
 	dstat, err := GetPathDiskStat(self.root)
 	if err != nil {
 		return err
@@ -151,58 +466,98 @@ func (self *FileSystem) WriteFile(filepath string, filemime string, metadata str
 		return ErrIndexStorageFully
 	}
 
-	filekey := []byte(filepath)
 	if !options.Overwrite {
 		var fnode *FileNode
-		if err := self.readNode(fileBucket, filekey, &fnode); err != nil {
+		if err := self.readNode(fileBucket, []byte(filepath), &fnode); err != nil {
 			return err
 		}
-		if fnode != nil {
+		if fnode != nil && !fnode.isExpired() {
 			return ErrExist
 		}
 	}
+	return nil
+}
+
+func (self *FileSystem) writeFile(filepath string, filemime string, metadata string, hashkey []byte, size int64, reader io.Reader, options *WriteOptions) error {
+	if options == nil {
+		options = defaultWriteOptions
+	}
+
+	self.writeLock.RLock()
+	defer self.writeLock.RUnlock()
+
+	if err := self.checkWritable(filepath, options); err != nil {
+		return err
+	}
 
-	var (
-		hnode *HashNode
-		fnode *FileNode
-	)
-	hashtmp := sha256.Sum256(data)
-	hashkey := hashtmp[:]
+	filekey := []byte(filepath)
+	var hnode *HashNode
 	if err := self.readNode(hashBucket, hashkey, &hnode); err != nil {
 		return err
 	}
-	if hnode != nil {
-		fnode = &FileNode{*hnode, filemime, metadata}
-	} else {
-		// CONFUSED: leak node when same hash concurrent write
-		var (
-			groupId       int
-			volumeStorage *VolumeStorage
-		)
-		for _, id := range self.volumeGroupIds {
-			storage := self.volumeStorages[id]
-			if f, _ := storage.IsFully(); !f {
-				groupId = id
-				volumeStorage = storage
-				break
-			}
-		}
+	var replicas []HashNode
+	fnode := &FileNode{
+		Mime:     filemime,
+		Metadata: metadata,
+		Hash:     hex.EncodeToString(hashkey),
+		Created:  time.Now().Unix(),
+		Expires:  options.Expires,
+		Version:  time.Now().UnixNano(),
+		Filename: options.Filename,
+		Meta:     options.Meta,
+	}
+	if hnode == nil {
+		groupId, volumeStorage := self.selectVolumeStorage(filepath)
 		if volumeStorage == nil {
 			return ErrVolumeStorageFully
 		}
-		volumeId, volumeOffset, err := volumeStorage.WriteFile(data)
+		volumeId, volumeOffset, err := volumeStorage.WriteFrom(reader, size, makeVolumeRecord(RecordKindData, filepath, fnode))
 		if err != nil {
 			return err
 		}
-		hnode = &HashNode{len(data), groupId, volumeId, volumeOffset}
-		if err := self.writeNode(hashBucket, hashkey, hnode); err != nil {
-			return err
-		}
-		self.timeOnUpdate = time.Now().Unix()
-		fnode = &FileNode{*hnode, filemime, metadata}
+		hnode = &HashNode{int(size), groupId, volumeId, volumeOffset}
+		replicas = self.writeReplicas(filepath, hashkey, hnode)
+	} else if err := self.writeRecord(RecordKindLink, filepath, fnode); err != nil {
+		return err
 	}
 
-	if err := self.writeNode(fileBucket, filekey, fnode); err != nil {
+	var ofnode *FileNode
+	err := self.storageDB.Update(func(tx *bolt.Tx) error {
+		if err := self.txReadNode(tx, fileBucket, filekey, &ofnode); err != nil {
+			return err
+		}
+		if ofnode != nil && !ofnode.isExpired() && !options.Overwrite {
+			return ErrExist
+		}
+		var xhnode *HashNode
+		if err := self.txReadNode(tx, hashBucket, hashkey, &xhnode); err != nil {
+			return err
+		}
+		if xhnode != nil {
+			// Same hash written concurrent, the data leaks until compaction
+			hnode = xhnode
+		} else if err := self.txWriteNode(tx, hashBucket, hashkey, hnode); err != nil {
+			return err
+		} else if err := self.txWriteReplicas(tx, hashkey, replicas); err != nil {
+			return err
+		}
+		fnode.HashNode = *hnode
+		if err := self.txWriteNode(tx, fileBucket, filekey, fnode); err != nil {
+			return err
+		}
+		if err := self.txUpdateExpires(tx, filekey, ofnode, fnode); err != nil {
+			return err
+		}
+		if err := self.txUpdateRefs(tx, hashkey, 1); err != nil {
+			return err
+		}
+		return self.txReleaseNode(tx, filekey, ofnode)
+	})
+	if err != nil {
+		if err == ErrExist {
+			// Revoke the record written above
+			self.writeRecord(RecordKindLink, filepath, ofnode)
+		}
 		return err
 	}
 	self.timeOnUpdate = time.Now().Unix()
@@ -210,18 +565,63 @@ func (self *FileSystem) WriteFile(filepath string, filemime string, metadata str
 }
 
 func (self *FileSystem) DeleteFile(filepath string) error {
+	return self.deleteFile(filepath, 0)
+}
+
+// The file is deleted only when its expires time matched, if it was not 0.
+// The file is moved to trash when trash enabled, except the expired file.
+func (self *FileSystem) deleteFile(filepath string, expires int64) error {
+	if err := self.checkReadOnly(); err != nil {
+		return err
+	}
+
+	self.writeLock.RLock()
+	defer self.writeLock.RUnlock()
+
 	filekey := []byte(filepath)
 	var fnode *FileNode
 	if err := self.readNode(fileBucket, filekey, &fnode); err != nil {
 		return err
 	}
-	if fnode == nil {
+	if fnode == nil || (expires > 0 && fnode.Expires != expires) {
 		return ErrNotExist
 	}
+	trash := self.config.TrashRetention > 0 && expires == 0
+	if trash {
+		// Keep the trash node in record, for index rebuilding
+		fnode.Deleted = time.Now().Unix()
+		if err := self.writeRecord(RecordKindDelete, filepath, fnode); err != nil {
+			return err
+		}
+	} else if err := self.writeRecord(RecordKindDelete, filepath, nil); err != nil {
+		return err
+	}
+	var xfnode *FileNode
 	if err := self.storageDB.Update(func(tx *bolt.Tx) error {
-		bt := tx.Bucket(fileBucket)
-		return bt.Delete(filekey)
+		if err := self.txReadNode(tx, fileBucket, filekey, &xfnode); err != nil {
+			return err
+		}
+		if xfnode == nil || (expires > 0 && xfnode.Expires != expires) {
+			return ErrNotExist
+		}
+		if err := tx.Bucket(fileBucket).Delete(filekey); err != nil {
+			return err
+		}
+		if err := self.txUpdateExpires(tx, filekey, xfnode, nil); err != nil {
+			return err
+		}
+		if !trash {
+			if err := self.txDeleteVersions(tx, filekey); err != nil {
+				return err
+			}
+			return self.txUpdateRefs(tx, xfnode.hashKey(), -1)
+		}
+		return self.txTrashNode(tx, filekey, xfnode, fnode.Deleted)
 	}); err != nil {
+		if err == ErrNotExist && xfnode != nil {
+			// Revoke the record written above
+			self.writeRecord(RecordKindLink, filepath, xfnode)
+		}
 		return err
 	}
 	self.timeOnUpdate = time.Now().Unix()
@@ -295,11 +695,19 @@ func NewFileSystem(root string, config *Storage) (*FileSystem, error) {
 		config:         config,
 		timeOnUpdate:   uptime,
 		timeOnSnapshot: uptime,
+		timeOnCompact:  uptime,
+		timeOnScrub:    uptime,
 		volumeGroupIds: []int{},
 		volumeStorages: map[int]*VolumeStorage{},
+		uploading:      map[string]bool{},
+		placeCurrents:  map[int]int{},
+		draining:       map[int]bool{},
+		drainRunning:   map[int]bool{},
+		drainResults:   map[int]*DrainResult{},
 	}
 	if err := fs.init(); err != nil {
 		return nil, err
 	}
+	fs.SetReadOnly(config.ReadOnly)
 	return fs, nil
 }
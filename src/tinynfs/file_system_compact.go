@@ -0,0 +1,399 @@
+package tinynfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	bolt "github.com/etcd-io/bbolt"
+	"sort"
+	"time"
+)
+
+const compactRetries = 3
+
+var errCompactChanged = errors.New("volume changed while compacting")
+
+type CompactResult struct {
+	GroupId   int   `json:"group_id"`
+	VolumeId  int64 `json:"volume_id"`
+	Size      int64 `json:"size"`
+	LiveSize  int64 `json:"live_size"`
+	LiveCount int   `json:"live_count"`
+}
+
+func (self *FileSystem) Compact(force bool) ([]*CompactResult, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return nil, err
+	}
+	if !force {
+		if self.config.CompactInterval <= 0 {
+			return nil, nil
+		}
+		if self.timeOnCompact+self.config.CompactInterval > time.Now().Unix() {
+			return nil, nil
+		}
+	}
+
+	self.compactLock.Lock()
+	defer self.compactLock.Unlock()
+
+	self.timeOnCompact = time.Now().Unix()
+	results := []*CompactResult{}
+	for _, groupId := range self.volumeGroupIds {
+		volumeStorage := self.volumeStorages[groupId]
+		for volumeId, size := range volumeStorage.SealedVolumes() {
+			result, err := self.compactVolume(groupId, volumeStorage, volumeId, size, force)
+			if err != nil {
+				return results, err
+			}
+			if result != nil {
+				results = append(results, result)
+			}
+		}
+	}
+	return results, nil
+}
+
+// The live records are collected and copied without the write lock, it is
+// only held to switch the nodes. The records deduplicated or replicated after
+// the collection are copied by the next round.
+func (self *FileSystem) compactVolume(groupId int, volumeStorage *VolumeStorage, volumeId int64, size int64, force bool) (*CompactResult, error) {
+	inVolume := func(node *HashNode) bool {
+		return node.GroupId == groupId && node.VolumeId == volumeId
+	}
+
+	// Collect the live records by the file nodes, the dead by the hash nodes
+	lives := map[int64]*VolumeRecord{}
+	deadSize := int64(0)
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		replicaDead, err := self.txCompactLives(tx, inVolume, lives)
+		if err != nil {
+			return err
+		}
+		deadSize += replicaDead
+		return tx.Bucket(hashBucket).ForEach(func(k, v []byte) error {
+			var hnode HashNode
+			if err := json.Unmarshal(v, &hnode); err != nil {
+				return err
+			}
+			if _, ok := lives[hnode.VolumeOffset]; inVolume(&hnode) && !ok {
+				deadSize += int64(hnode.Size)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if deadSize < 1 {
+		return nil, nil
+	}
+	if !force && deadSize*100 < size*int64(self.config.CompactThreshold) {
+		return nil, nil
+	}
+
+	// Copy the live records to the writable volume
+	moves := map[int64]*HashNode{}
+	liveSize := int64(0)
+	copyLives := func() error {
+		offsets := []int64{}
+		for offset := range lives {
+			if moves[offset] == nil {
+				offsets = append(offsets, offset)
+			}
+		}
+		sort.Slice(offsets, func(i, j int) bool {
+			return offsets[i] < offsets[j]
+		})
+		for _, offset := range offsets {
+			record := lives[offset]
+			orecord, data, err := volumeStorage.ReadRecord(volumeId, offset, record.Size)
+			if err != nil {
+				return err
+			}
+			// Keep the origin record header, raw volume has not
+			if orecord != nil {
+				record = orecord
+			}
+			newVolumeId, newVolumeOffset, err := volumeStorage.WriteFile(data, record)
+			if err != nil {
+				return err
+			}
+			moves[offset] = &HashNode{record.Size, groupId, newVolumeId, newVolumeOffset}
+			liveSize += int64(record.Size)
+		}
+		return nil
+	}
+	if err := copyLives(); err != nil {
+		return nil, err
+	}
+	if volumeStorage.VolumeVersion(volumeId) == VolumeVersionRecord {
+		if err := self.compactLinks(volumeStorage, volumeId, volumeStorage); err != nil {
+			return nil, err
+		}
+	}
+
+	for retry := 0; ; retry++ {
+		// Switch the nodes to new location, discard the dead hash nodes
+		self.writeLock.Lock()
+		err = self.storageDB.Update(func(tx *bolt.Tx) error {
+			return self.txCompactSwitch(tx, inVolume, moves)
+		})
+		self.writeLock.Unlock()
+		if err != errCompactChanged {
+			break
+		}
+		if retry >= compactRetries {
+			// The copied records are dead, they are discarded by the next compaction
+			return nil, nil
+		}
+		err = self.storageDB.View(func(tx *bolt.Tx) error {
+			_, err := self.txCompactLives(tx, inVolume, lives)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		if err := copyLives(); err != nil {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	self.timeOnUpdate = time.Now().Unix()
+
+	if err := volumeStorage.RemoveVolume(volumeId); err != nil {
+		return nil, err
+	}
+	return &CompactResult{
+		GroupId:   groupId,
+		VolumeId:  volumeId,
+		Size:      size,
+		LiveSize:  liveSize,
+		LiveCount: len(moves),
+	}, nil
+}
+
+// txCompactLives adds the live records of the volume which are not collected
+// yet, the size of the dead replicas is returned.
+func (self *FileSystem) txCompactLives(tx *bolt.Tx, inVolume func(*HashNode) bool, lives map[int64]*VolumeRecord) (int64, error) {
+	for _, bucket := range nodeBuckets {
+		err := tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+			var fnode FileNode
+			if err := json.Unmarshal(v, &fnode); err != nil {
+				return err
+			}
+			if _, ok := lives[fnode.VolumeOffset]; inVolume(&fnode.HashNode) && !ok {
+				lives[fnode.VolumeOffset] = compactRecord(bucket, k, &fnode)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	// The replicas of the live data are alive too
+	deadSize := int64(0)
+	err := tx.Bucket(replicaBucket).ForEach(func(k, v []byte) error {
+		var replicas []HashNode
+		if err := json.Unmarshal(v, &replicas); err != nil {
+			return err
+		}
+		for _, hnode := range replicas {
+			if !inVolume(&hnode) {
+				continue
+			}
+			if self.txReadRefs(tx, k) < 1 {
+				deadSize += int64(hnode.Size)
+			} else if _, ok := lives[hnode.VolumeOffset]; !ok {
+				lives[hnode.VolumeOffset] = replicaRecord(k, &hnode)
+			}
+		}
+		return nil
+	})
+	return deadSize, err
+}
+
+// txCompactSwitch fails by errCompactChanged when a live record was not copied
+func (self *FileSystem) txCompactSwitch(tx *bolt.Tx, inVolume func(*HashNode) bool, moves map[int64]*HashNode) error {
+	for _, bucket := range nodeBuckets {
+		bt := tx.Bucket(bucket)
+		fnodes := map[string]*FileNode{}
+		err := bt.ForEach(func(k, v []byte) error {
+			var fnode FileNode
+			if err := json.Unmarshal(v, &fnode); err != nil {
+				return err
+			}
+			if !inVolume(&fnode.HashNode) {
+				return nil
+			}
+			hnode := moves[fnode.VolumeOffset]
+			if hnode == nil {
+				// Deduplicated after the collection
+				return errCompactChanged
+			}
+			fnode.HashNode = *hnode
+			fnodes[string(k)] = &fnode
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, fnode := range fnodes {
+			b, err := json.Marshal(fnode)
+			if err != nil {
+				return err
+			}
+			if err := bt.Put([]byte(k), b); err != nil {
+				return err
+			}
+		}
+	}
+
+	rbt := tx.Bucket(replicaBucket)
+	replicas := map[string][]HashNode{}
+	err := rbt.ForEach(func(k, v []byte) error {
+		var xreplicas []HashNode
+		if err := json.Unmarshal(v, &xreplicas); err != nil {
+			return err
+		}
+		changed := false
+		nreplicas := []HashNode{}
+		for _, hnode := range xreplicas {
+			if !inVolume(&hnode) {
+				nreplicas = append(nreplicas, hnode)
+				continue
+			}
+			changed = true
+			if self.txReadRefs(tx, k) < 1 {
+				continue
+			}
+			mnode := moves[hnode.VolumeOffset]
+			if mnode == nil {
+				// Replicated after the collection
+				return errCompactChanged
+			}
+			nreplicas = append(nreplicas, *mnode)
+		}
+		if changed {
+			replicas[string(k)] = nreplicas
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, nreplicas := range replicas {
+		if err := self.txWriteReplicas(tx, []byte(k), nreplicas); err != nil {
+			return err
+		}
+	}
+
+	hbt := tx.Bucket(hashBucket)
+	hnodes := map[string]*HashNode{}
+	err = hbt.ForEach(func(k, v []byte) error {
+		var hnode HashNode
+		if err := json.Unmarshal(v, &hnode); err != nil {
+			return err
+		}
+		if inVolume(&hnode) {
+			hnodes[string(k)] = moves[hnode.VolumeOffset]
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for k, hnode := range hnodes {
+		if hnode == nil {
+			if err := hbt.Delete([]byte(k)); err != nil {
+				return err
+			}
+			if err := self.txWriteRefs(tx, []byte(k), 0); err != nil {
+				return err
+			}
+			// The replicas of dead data are removed by compaction of them
+			if err := self.txWriteReplicas(tx, []byte(k), nil); err != nil {
+				return err
+			}
+			continue
+		}
+		b, err := json.Marshal(hnode)
+		if err != nil {
+			return err
+		}
+		if err := hbt.Put([]byte(k), b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Keep the link and delete records which still describe the file path,
+// they are required by index rebuilding.
+// The link and delete records still in effect are written to the dst storage
+func (self *FileSystem) compactLinks(volumeStorage *VolumeStorage, volumeId int64, dstStorage *VolumeStorage) error {
+	records := []*VolumeRecord{}
+	err := volumeStorage.WalkVolume(volumeId, func(record *VolumeRecord) error {
+		if record.Kind != RecordKindLink && record.Kind != RecordKindDelete {
+			return nil
+		}
+		var fnode *FileNode
+		if err := self.readNode(fileBucket, []byte(record.FilePath), &fnode); err != nil {
+			return err
+		}
+		if record.Kind == RecordKindDelete && fnode == nil {
+			records = append(records, record)
+		} else if record.Kind == RecordKindLink && fnode != nil && isSameHash(fnode.hashKey(), record.Hash) {
+			records = append(records, record)
+		} else if record.Kind == RecordKindLink && len(record.Extra) > 0 {
+			// The link record of the kept version
+			var xnode FileNode
+			if err := json.Unmarshal(record.Extra, &xnode); err != nil {
+				return err
+			}
+			var vnode *FileNode
+			if err := self.readNode(versionBucket, encodeVersionKey([]byte(record.FilePath), xnode.versionId()), &vnode); err != nil {
+				return err
+			}
+			if vnode != nil && isSameHash(vnode.hashKey(), record.Hash) {
+				records = append(records, record)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, record := range records {
+		if _, _, err := dstStorage.WriteFile(nil, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isSameHash(a []byte, b []byte) bool {
+	return a != nil && bytes.Equal(a, b)
+}
+
+// The record of the node out of file bucket has no file path, it must not
+// be restored as a file by index rebuilding.
+func compactRecord(bucket []byte, filekey []byte, fnode *FileNode) *VolumeRecord {
+	filepath := ""
+	if bytes.Equal(bucket, fileBucket) {
+		filepath = string(filekey)
+	}
+	record := makeVolumeRecord(RecordKindData, filepath, fnode)
+	record.Size = fnode.Size
+	return record
+}
+
+func replicaRecord(hashkey []byte, hnode *HashNode) *VolumeRecord {
+	return &VolumeRecord{
+		Kind: RecordKindData,
+		Size: hnode.Size,
+		Hash: append([]byte{}, hashkey...),
+	}
+}
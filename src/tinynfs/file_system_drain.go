@@ -0,0 +1,408 @@
+package tinynfs
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"log"
+	"strconv"
+	"time"
+)
+
+type DrainResult struct {
+	GroupId  int   `json:"group_id"`
+	Hashs    int   `json:"hashs"`
+	Moved    int   `json:"moved"`
+	Promoted int   `json:"promoted"`
+	Dropped  int   `json:"dropped"`
+	Removed  int   `json:"removed"`
+	Failed   int   `json:"failed"`
+	Started  int64 `json:"started"`
+	Finished int64 `json:"finished"`
+}
+
+type DrainStatus struct {
+	GroupId   int          `json:"group_id"`
+	Draining  bool         `json:"draining"`
+	Running   bool         `json:"running"`
+	Remaining int          `json:"remaining"`
+	Removable bool         `json:"removable"`
+	Last      *DrainResult `json:"last"`
+}
+
+type drainHash struct {
+	hashkey  []byte
+	primary  HashNode
+	replicas []HashNode
+	refs     int64
+	moved    *HashNode
+	others   []HashNode
+}
+
+func encodeDrainKey(groupId int) []byte {
+	return []byte(strconv.Itoa(groupId))
+}
+
+// The draining groups were marked in index storage, they keep read-only
+// after restart.
+func (self *FileSystem) loadDraining() error {
+	return self.storageDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(drainBucket).ForEach(func(k, v []byte) error {
+			groupId, err := strconv.Atoi(string(k))
+			if err != nil {
+				return err
+			}
+			if self.volumeStorages[groupId] != nil {
+				self.draining[groupId] = true
+			}
+			return nil
+		})
+	})
+}
+
+func (self *FileSystem) isDraining(groupId int) bool {
+	self.placeLock.Lock()
+	defer self.placeLock.Unlock()
+
+	return self.draining[groupId]
+}
+
+func (self *FileSystem) markDraining(groupId int, draining bool) error {
+	err := self.storageDB.Update(func(tx *bolt.Tx) error {
+		if !draining {
+			return tx.Bucket(drainBucket).Delete(encodeDrainKey(groupId))
+		}
+		return tx.Bucket(drainBucket).Put(encodeDrainKey(groupId), []byte(strconv.FormatInt(time.Now().Unix(), 10)))
+	})
+	if err != nil {
+		return err
+	}
+	self.placeLock.Lock()
+	defer self.placeLock.Unlock()
+
+	if draining {
+		self.draining[groupId] = true
+	} else {
+		delete(self.draining, groupId)
+	}
+	return nil
+}
+
+func (self *FileSystem) lockDrain(groupId int) error {
+	self.drainLock.Lock()
+	defer self.drainLock.Unlock()
+
+	if self.drainRunning[groupId] {
+		return ErrDrainBusy
+	}
+	self.drainRunning[groupId] = true
+	return nil
+}
+
+// StartDrain marks the volume group read-only, then moves its data to the
+// other groups in background.
+func (self *FileSystem) StartDrain(groupId int) error {
+	if err := self.checkReadOnly(); err != nil {
+		return err
+	}
+	if self.volumeStorages[groupId] == nil {
+		return ErrNotExist
+	}
+	if _, volumeStorage := self.placeVolumeGroup("", map[int]bool{groupId: true}); volumeStorage == nil {
+		return ErrVolumeStorageFully
+	}
+	if err := self.lockDrain(groupId); err != nil {
+		return err
+	}
+	if err := self.markDraining(groupId, true); err != nil {
+		self.drainLock.Lock()
+		delete(self.drainRunning, groupId)
+		self.drainLock.Unlock()
+		return err
+	}
+	go self.drain(groupId)
+	return nil
+}
+
+// CancelDrain makes the volume group writable again, the moved data is not
+// moved back.
+func (self *FileSystem) CancelDrain(groupId int) error {
+	if self.volumeStorages[groupId] == nil {
+		return ErrNotExist
+	}
+	if err := self.lockDrain(groupId); err != nil {
+		return err
+	}
+	defer func() {
+		self.drainLock.Lock()
+		delete(self.drainRunning, groupId)
+		self.drainLock.Unlock()
+	}()
+	return self.markDraining(groupId, false)
+}
+
+// DrainStatus counts the nodes still located in the volume group, the group
+// can be removed from configuration when nothing remains.
+func (self *FileSystem) DrainStatus(groupId int) (*DrainStatus, error) {
+	if self.volumeStorages[groupId] == nil {
+		return nil, ErrNotExist
+	}
+	status := &DrainStatus{
+		GroupId:  groupId,
+		Draining: self.isDraining(groupId),
+	}
+	self.drainLock.Lock()
+	status.Running = self.drainRunning[groupId]
+	status.Last = self.drainResults[groupId]
+	self.drainLock.Unlock()
+
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		for _, bucket := range append([][]byte{hashBucket}, nodeBuckets...) {
+			err := tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+				var hnode HashNode
+				if err := json.Unmarshal(v, &hnode); err != nil {
+					return err
+				}
+				if hnode.GroupId == groupId {
+					status.Remaining++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(replicaBucket).ForEach(func(k, v []byte) error {
+			var replicas []HashNode
+			if err := json.Unmarshal(v, &replicas); err != nil {
+				return err
+			}
+			for _, hnode := range replicas {
+				if hnode.GroupId == groupId {
+					status.Remaining++
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	status.Removable = status.Draining && !status.Running && status.Remaining < 1
+	return status, nil
+}
+
+func (self *FileSystem) drain(groupId int) (*DrainResult, error) {
+	result := &DrainResult{
+		GroupId: groupId,
+		Started: time.Now().Unix(),
+	}
+	defer func() {
+		result.Finished = time.Now().Unix()
+		self.drainLock.Lock()
+		delete(self.drainRunning, groupId)
+		self.drainResults[groupId] = result
+		self.drainLock.Unlock()
+	}()
+
+	if err := self.drainGroup(groupId, result); err != nil {
+		log.Println(fmt.Sprintf("drain volume group %d failed %s", groupId, err))
+		return result, err
+	}
+	// The dropped replicas are re-created in the other groups
+	if self.replicaCount() > 1 {
+		if _, err := self.RepairReplicas(); err != nil {
+			log.Println(fmt.Sprintf("drain volume group %d failed %s", groupId, err))
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (self *FileSystem) drainGroup(groupId int, result *DrainResult) error {
+	self.compactLock.Lock()
+	defer self.compactLock.Unlock()
+
+	// Collect the hash nodes located in the group
+	hashs := []*drainHash{}
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(hashBucket).ForEach(func(k, v []byte) error {
+			var primary HashNode
+			if err := json.Unmarshal(v, &primary); err != nil {
+				return err
+			}
+			replicas, err := self.txReadReplicas(tx, k)
+			if err != nil {
+				return err
+			}
+			others := []HashNode{}
+			for _, hnode := range replicas {
+				if hnode.GroupId != groupId {
+					others = append(others, hnode)
+				}
+			}
+			if primary.GroupId != groupId && len(others) == len(replicas) {
+				return nil
+			}
+			hashs = append(hashs, &drainHash{
+				hashkey:  append([]byte{}, k...),
+				primary:  primary,
+				replicas: replicas,
+				refs:     self.txReadRefs(tx, k),
+				others:   others,
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	// Copy the live data to the other groups
+	for _, h := range hashs {
+		result.Hashs++
+		if h.refs < 1 || h.primary.GroupId != groupId {
+			continue
+		}
+		if err := self.drainData(groupId, h); err == nil {
+			result.Moved++
+		} else if self.promoteReplica(h) {
+			result.Promoted++
+		} else {
+			log.Println(fmt.Sprintf("drain %x failed %s", h.hashkey, err))
+			result.Failed++
+		}
+	}
+
+	// Switch the nodes to the new location
+	self.writeLock.Lock()
+	err = self.storageDB.Update(func(tx *bolt.Tx) error {
+		moves := map[HashNode]HashNode{}
+		for _, h := range hashs {
+			var primary *HashNode
+			if err := self.txReadNode(tx, hashBucket, h.hashkey, &primary); err != nil {
+				return err
+			}
+			if primary == nil || *primary != h.primary {
+				continue
+			}
+			if h.primary.GroupId == groupId && h.moved == nil {
+				// The dead data maybe deduplicated after the collection
+				if self.txReadRefs(tx, h.hashkey) > 0 {
+					continue
+				}
+				if err := tx.Bucket(hashBucket).Delete(h.hashkey); err != nil {
+					return err
+				}
+				if err := self.txWriteReplicas(tx, h.hashkey, nil); err != nil {
+					return err
+				}
+				result.Removed++
+				continue
+			}
+			if h.moved != nil {
+				if err := self.txWriteNode(tx, hashBucket, h.hashkey, h.moved); err != nil {
+					return err
+				}
+				moves[h.primary] = *h.moved
+			}
+			if err := self.txWriteReplicas(tx, h.hashkey, h.others); err != nil {
+				return err
+			}
+		}
+		if len(moves) < 1 {
+			return nil
+		}
+		for _, bucket := range nodeBuckets {
+			bt := tx.Bucket(bucket)
+			fnodes := map[string]*FileNode{}
+			err := bt.ForEach(func(k, v []byte) error {
+				var fnode FileNode
+				if err := json.Unmarshal(v, &fnode); err != nil {
+					return err
+				}
+				if hnode, ok := moves[fnode.HashNode]; ok {
+					fnode.HashNode = hnode
+					fnodes[string(k)] = &fnode
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, fnode := range fnodes {
+				if err := self.txWriteNode(tx, bucket, []byte(k), fnode); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	self.writeLock.Unlock()
+	if err != nil {
+		return err
+	}
+	self.timeOnUpdate = time.Now().Unix()
+	for _, h := range hashs {
+		result.Dropped += len(h.replicas) - len(h.others)
+	}
+
+	// Keep the link records for index rebuilding
+	volumeStorage := self.volumeStorages[groupId]
+	_, dstStorage := self.placeVolumeGroup("", map[int]bool{groupId: true})
+	if dstStorage == nil {
+		return ErrVolumeStorageFully
+	}
+	for _, volumeId := range volumeStorage.VolumeIds() {
+		if volumeStorage.VolumeVersion(volumeId) != VolumeVersionRecord {
+			continue
+		}
+		if err := self.compactLinks(volumeStorage, volumeId, dstStorage); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Copy the data with its origin record, so the file path is kept for index
+// rebuilding.
+func (self *FileSystem) drainData(groupId int, h *drainHash) error {
+	volumeStorage := self.volumeStorages[groupId]
+	record, data, err := volumeStorage.ReadRecord(h.primary.VolumeId, h.primary.VolumeOffset, h.primary.Size)
+	if err != nil {
+		return err
+	}
+	if hashkey := sha256.Sum256(data); !isSameHash(h.hashkey, hashkey[:]) {
+		return ErrVolumeData
+	}
+	if record == nil {
+		record = replicaRecord(h.hashkey, &h.primary)
+	}
+	used := map[int]bool{groupId: true}
+	for _, hnode := range h.others {
+		used[hnode.GroupId] = true
+	}
+	dstGroupId, dstStorage := self.placeVolumeGroup(record.FilePath, used)
+	if dstStorage == nil {
+		return ErrVolumeStorageFully
+	}
+	volumeId, volumeOffset, err := dstStorage.WriteFile(data, record)
+	if err != nil {
+		return err
+	}
+	h.moved = &HashNode{h.primary.Size, dstGroupId, volumeId, volumeOffset}
+	return nil
+}
+
+// The healthy replica is promoted when the data of the group can not be copied
+func (self *FileSystem) promoteReplica(h *drainHash) bool {
+	for i, hnode := range h.others {
+		if self.isHealthy(h.hashkey, &hnode) {
+			h.moved = &h.others[i]
+			h.others = append(append([]HashNode{}, h.others[:i]...), h.others[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
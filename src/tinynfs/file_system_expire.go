@@ -0,0 +1,72 @@
+package tinynfs
+
+import (
+	"encoding/binary"
+	bolt "github.com/etcd-io/bbolt"
+	"time"
+)
+
+const (
+	expireBatchSize = 1000
+)
+
+// The key of expires bucket is the expires time then the file path, so the
+// keys are sorted by time.
+func encodeExpireKey(expires int64, filekey []byte) []byte {
+	key := make([]byte, 8+len(filekey))
+	binary.BigEndian.PutUint64(key, uint64(expires))
+	copy(key[8:], filekey)
+	return key
+}
+
+func (self *FileSystem) txUpdateExpires(tx *bolt.Tx, filekey []byte, ofnode *FileNode, fnode *FileNode) error {
+	bt := tx.Bucket(expireBucket)
+	if ofnode != nil && ofnode.Expires > 0 {
+		if err := bt.Delete(encodeExpireKey(ofnode.Expires, filekey)); err != nil {
+			return err
+		}
+	}
+	if fnode != nil && fnode.Expires > 0 {
+		return bt.Put(encodeExpireKey(fnode.Expires, filekey), []byte{})
+	}
+	return nil
+}
+
+// CleanExpires deletes the expired files by the expires order, the expired
+// file was not readable before it was deleted.
+func (self *FileSystem) CleanExpires() int {
+	if self.IsReadOnly() {
+		return 0
+	}
+	count := 0
+	for {
+		keys := [][]byte{}
+		now := time.Now().Unix()
+		self.storageDB.View(func(tx *bolt.Tx) error {
+			c := tx.Bucket(expireBucket).Cursor()
+			for k, _ := c.First(); k != nil && len(keys) < expireBatchSize; k, _ = c.Next() {
+				if int64(binary.BigEndian.Uint64(k)) > now {
+					break
+				}
+				keys = append(keys, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if len(keys) < 1 {
+			return count
+		}
+		for _, key := range keys {
+			err := self.deleteFile(string(key[8:]), int64(binary.BigEndian.Uint64(key)))
+			if err == nil {
+				count++
+			} else if err == ErrNotExist {
+				// The file was deleted or rewritten
+				self.storageDB.Update(func(tx *bolt.Tx) error {
+					return tx.Bucket(expireBucket).Delete(key)
+				})
+			} else {
+				return count
+			}
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package tinynfs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	bolt "github.com/etcd-io/bbolt"
+	"strings"
+)
+
+const (
+	listDefaultLimit = 1000
+	listMaxLimit     = 1000
+)
+
+type ListEntry struct {
+	FilePath string `json:"filepath"`
+	Size     int    `json:"size"`
+	Mime     string `json:"mime"`
+	Metadata string `json:"metadata"`
+	Hash     string `json:"hash"`
+	Created  int64  `json:"created"`
+	Expires  int64  `json:"expires"`
+	Deleted  int64  `json:"deleted,omitempty"`
+	Version  int64  `json:"version,omitempty"`
+	Filename string `json:"filename,omitempty"`
+
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+type ListResult struct {
+	Files    []*ListEntry `json:"files"`
+	Prefixes []string     `json:"prefixes"`
+	Cursor   string       `json:"cursor"`
+}
+
+func encodeListCursor(key []byte) string {
+	return base64.RawURLEncoding.EncodeToString(key)
+}
+
+// The smallest key after every key with the prefix
+func prefixUpperBound(prefix []byte) []byte {
+	key := append([]byte{}, prefix...)
+	for i := len(key) - 1; i >= 0; i-- {
+		if key[i] < 0xFF {
+			key[i]++
+			return key[:i+1]
+		}
+	}
+	return nil
+}
+
+// List returns the files and the common prefixes under the prefix, in key
+// order. The file paths contain the delimiter after the prefix are rolled up
+// into a common prefix. The cursor is the token to continue the listing.
+func (self *FileSystem) List(prefix string, delimiter string, cursor string, limit int) (*ListResult, error) {
+	return self.listNodes(fileBucket, prefix, delimiter, cursor, limit)
+}
+
+func (self *FileSystem) listNodes(bucket []byte, prefix string, delimiter string, cursor string, limit int) (*ListResult, error) {
+	if limit <= 0 {
+		limit = listDefaultLimit
+	} else if limit > listMaxLimit {
+		limit = listMaxLimit
+	}
+	start := []byte(prefix)
+	if len(cursor) > 0 {
+		key, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || !bytes.HasPrefix(key, start) {
+			return nil, ErrParam
+		}
+		start = key
+	}
+
+	result := &ListResult{
+		Files:    []*ListEntry{},
+		Prefixes: []string{},
+	}
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		k, v := c.Seek(start)
+		for ; k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Seek(start) {
+			if len(result.Files)+len(result.Prefixes) >= limit {
+				result.Cursor = encodeListCursor(start)
+				return nil
+			}
+			path := string(k)
+			if len(delimiter) > 0 {
+				if i := strings.Index(path[len(prefix):], delimiter); i >= 0 {
+					common := path[:len(prefix)+i+len(delimiter)]
+					result.Prefixes = append(result.Prefixes, common)
+					if start = prefixUpperBound([]byte(common)); start == nil {
+						return nil
+					}
+					continue
+				}
+			}
+			var fnode FileNode
+			if err := json.Unmarshal(v, &fnode); err != nil {
+				return err
+			}
+			start = append(append([]byte{}, k...), 0)
+			if fnode.isExpired() && fnode.Deleted == 0 {
+				continue
+			}
+			result.Files = append(result.Files, &ListEntry{
+				FilePath: path,
+				Size:     fnode.Size,
+				Mime:     fnode.Mime,
+				Metadata: fnode.Metadata,
+				Hash:     fnode.Hash,
+				Created:  fnode.Created,
+				Expires:  fnode.Expires,
+				Deleted:  fnode.Deleted,
+				Version:  fnode.Version,
+				Filename: fnode.Filename,
+				Meta:     fnode.Meta,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -0,0 +1,149 @@
+package tinynfs
+
+import (
+	"bytes"
+	"encoding/json"
+	bolt "github.com/etcd-io/bbolt"
+	"strings"
+	"time"
+)
+
+type transferItem struct {
+	src   string
+	dst   string
+	fnode *FileNode
+}
+
+func (self *FileSystem) Rename(src string, dst string, overwrite bool) error {
+	if src == dst {
+		return ErrParam
+	}
+	_, err := self.transferFiles(src, dst, false, overwrite, true)
+	return err
+}
+
+// RenamePrefix renames every file under the prefix src to the prefix dst,
+// the prefixes must end with "/".
+func (self *FileSystem) RenamePrefix(src string, dst string, overwrite bool) (int, error) {
+	if !strings.HasSuffix(src, "/") || !strings.HasSuffix(dst, "/") {
+		return 0, ErrParam
+	}
+	if strings.HasPrefix(src, dst) || strings.HasPrefix(dst, src) {
+		return 0, ErrParam
+	}
+	return self.transferFiles(src, dst, true, overwrite, true)
+}
+
+func (self *FileSystem) Copy(src string, dst string, overwrite bool) error {
+	if src == dst {
+		return ErrParam
+	}
+	_, err := self.transferFiles(src, dst, false, overwrite, false)
+	return err
+}
+
+// The file data was shared by sha256, only the index and the records changed
+func (self *FileSystem) transferFiles(src string, dst string, prefix bool, overwrite bool, move bool) (int, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return 0, err
+	}
+
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	items := []*transferItem{}
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		bt := tx.Bucket(fileBucket)
+		c := bt.Cursor()
+		for k, v := c.Seek([]byte(src)); k != nil; k, v = c.Next() {
+			if prefix && !bytes.HasPrefix(k, []byte(src)) {
+				break
+			} else if !prefix && string(k) != src {
+				break
+			}
+			var fnode FileNode
+			if err := json.Unmarshal(v, &fnode); err != nil {
+				return err
+			}
+			if fnode.isExpired() {
+				if !prefix {
+					break
+				}
+				continue
+			}
+			path := string(k)
+			item := &transferItem{path, dst + path[len(src):], &fnode}
+			if !overwrite {
+				var ofnode *FileNode
+				if err := self.txReadNode(tx, fileBucket, []byte(item.dst), &ofnode); err != nil {
+					return err
+				}
+				if ofnode != nil && !ofnode.isExpired() {
+					return ErrExist
+				}
+			}
+			items = append(items, item)
+			if !prefix {
+				break
+			}
+		}
+		if len(items) < 1 {
+			return ErrNotExist
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, item := range items {
+		if err := self.writeRecord(RecordKindLink, item.dst, item.fnode); err != nil {
+			return 0, err
+		}
+		if move {
+			if err := self.writeRecord(RecordKindDelete, item.src, nil); err != nil {
+				return 0, err
+			}
+		}
+	}
+	err = self.storageDB.Update(func(tx *bolt.Tx) error {
+		for _, item := range items {
+			var ofnode *FileNode
+			if err := self.txReadNode(tx, fileBucket, []byte(item.dst), &ofnode); err != nil {
+				return err
+			}
+			if err := self.txWriteNode(tx, fileBucket, []byte(item.dst), item.fnode); err != nil {
+				return err
+			}
+			if err := self.txUpdateExpires(tx, []byte(item.dst), ofnode, item.fnode); err != nil {
+				return err
+			}
+			if err := self.txUpdateRefs(tx, item.fnode.hashKey(), 1); err != nil {
+				return err
+			}
+			if err := self.txReleaseNode(tx, []byte(item.dst), ofnode); err != nil {
+				return err
+			}
+			if move {
+				if err := tx.Bucket(fileBucket).Delete([]byte(item.src)); err != nil {
+					return err
+				}
+				if err := self.txUpdateExpires(tx, []byte(item.src), item.fnode, nil); err != nil {
+					return err
+				}
+				if err := self.txUpdateRefs(tx, item.fnode.hashKey(), -1); err != nil {
+					return err
+				}
+				if err := self.txMoveVersions(tx, []byte(item.src), []byte(item.dst)); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	self.timeOnUpdate = time.Now().Unix()
+	return len(items), nil
+}
@@ -0,0 +1,137 @@
+package tinynfs
+
+import (
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+const (
+	VolumePolicyFirst      = "first"
+	VolumePolicyRoundRobin = "roundrobin"
+	VolumePolicyFreeSpace  = "freespace"
+	VolumePolicyWeighted   = "weighted"
+	VolumePolicyHash       = "hash"
+)
+
+var (
+	volumePolicies = map[string]bool{
+		VolumePolicyFirst:      true,
+		VolumePolicyRoundRobin: true,
+		VolumePolicyFreeSpace:  true,
+		VolumePolicyWeighted:   true,
+		VolumePolicyHash:       true,
+	}
+)
+
+func (self *VolumeGroup) weight() int {
+	if self.Weight < 1 {
+		return 1
+	}
+	return self.Weight
+}
+
+// The first directory of file path, the root is the prefix of its files
+func placementPrefix(filepath string) string {
+	if i := strings.Index(strings.TrimPrefix(filepath, "/"), "/"); i >= 0 {
+		return filepath[:i+2]
+	}
+	return "/"
+}
+
+// placeVolumeGroup selects the writable volume group by the policy, the
+// used and the draining groups are skipped.
+func (self *FileSystem) placeVolumeGroup(filepath string, used map[int]bool) (int, *VolumeStorage) {
+	groups := []*VolumeGroup{}
+	for i, v := range self.config.VolumeFileGroups {
+		if used[v.Id] || self.isDraining(v.Id) {
+			continue
+		}
+		if f, _ := self.volumeStorages[v.Id].IsFully(); !f {
+			groups = append(groups, &self.config.VolumeFileGroups[i])
+		}
+	}
+	if len(groups) < 1 {
+		return -1, nil
+	}
+
+	var group *VolumeGroup
+	switch self.config.VolumePolicy {
+	case VolumePolicyRoundRobin:
+		group = self.placeRoundRobin(groups)
+	case VolumePolicyFreeSpace:
+		group = self.placeFreeSpace(groups)
+	case VolumePolicyWeighted:
+		group = self.placeWeighted(groups)
+	case VolumePolicyHash:
+		group = placeHash(groups, placementPrefix(filepath))
+	default:
+		group = groups[0]
+	}
+	return group.Id, self.volumeStorages[group.Id]
+}
+
+func (self *FileSystem) placeRoundRobin(groups []*VolumeGroup) *VolumeGroup {
+	self.placeLock.Lock()
+	defer self.placeLock.Unlock()
+
+	self.placeNext++
+	return groups[self.placeNext%len(groups)]
+}
+
+func (self *FileSystem) placeFreeSpace(groups []*VolumeGroup) *VolumeGroup {
+	var (
+		group *VolumeGroup
+		free  uint64
+	)
+	for _, v := range groups {
+		dstat, err := GetPathDiskStat(self.volumeStorages[v.Id].root)
+		if err != nil {
+			continue
+		}
+		if group == nil || dstat.Free > free {
+			group, free = v, dstat.Free
+		}
+	}
+	if group == nil {
+		return groups[0]
+	}
+	return group
+}
+
+// The smooth weighted round-robin, the groups are selected in proportion to
+// the weights and interleaved.
+func (self *FileSystem) placeWeighted(groups []*VolumeGroup) *VolumeGroup {
+	self.placeLock.Lock()
+	defer self.placeLock.Unlock()
+
+	var group *VolumeGroup
+	total := 0
+	for _, v := range groups {
+		total += v.weight()
+		self.placeCurrents[v.Id] += v.weight()
+		if group == nil || self.placeCurrents[v.Id] > self.placeCurrents[group.Id] {
+			group = v
+		}
+	}
+	self.placeCurrents[group.Id] -= total
+	return group
+}
+
+// The rendezvous hashing, the files of a prefix are kept in the same group,
+// only the prefixes of a fully group are moved to the others.
+func placeHash(groups []*VolumeGroup, prefix string) *VolumeGroup {
+	var (
+		group *VolumeGroup
+		score uint64
+	)
+	for _, v := range groups {
+		h := fnv.New64a()
+		h.Write([]byte(prefix))
+		h.Write([]byte(strconv.Itoa(v.Id)))
+		if s := h.Sum64(); group == nil || s > score {
+			group, score = v, s
+		}
+	}
+	return group
+}
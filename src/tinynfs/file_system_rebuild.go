@@ -0,0 +1,405 @@
+package tinynfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+type RebuildConflict struct {
+	FilePath  string `json:"filepath"`
+	Count     int    `json:"count"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type RebuildResult struct {
+	Volumes   int                `json:"volumes"`
+	Records   int                `json:"records"`
+	Files     int                `json:"files"`
+	Hashs     int                `json:"hashs"`
+	Deleted   int                `json:"deleted"`
+	Missing   []string           `json:"missing"`
+	Skipped   []string           `json:"skipped"`
+	Conflicts []*RebuildConflict `json:"conflicts"`
+	Backup    string             `json:"backup"`
+}
+
+type rebuildEntry struct {
+	conflicts int
+	record    *VolumeRecord
+	versions  []*VolumeRecord
+}
+
+type volumeRecords struct {
+	volumes int
+	records int
+	files   map[string]*rebuildEntry
+	hashs   map[string]*HashNode
+	groups  map[string]map[int]*HashNode
+	skipped []string
+}
+
+// lockIndexStorage opens the index storage to hold its file lock, so the
+// server can't open it until the storage was replaced and the lock closed.
+func lockIndexStorage(dbpath string) (*bolt.DB, error) {
+	if _, err := os.Stat(dbpath); err != nil {
+		return nil, nil
+	}
+	db, err := bolt.Open(dbpath, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		if err == bolt.ErrTimeout {
+			err = ErrIndexStorageBusy
+		}
+		return nil, err
+	}
+	return db, nil
+}
+
+func unlockIndexStorage(db *bolt.DB) {
+	if db != nil {
+		db.Close()
+	}
+}
+
+func replaceIndexStorage(dbpath string, tmppath string) (string, error) {
+	backup := ""
+	if _, err := os.Stat(dbpath); err == nil {
+		backup = fmt.Sprintf("%s.%d.bak", dbpath, time.Now().UnixNano())
+		if err := os.Rename(dbpath, backup); err != nil {
+			return "", err
+		}
+	}
+	if err := os.Rename(tmppath, dbpath); err != nil {
+		return "", err
+	}
+	return backup, nil
+}
+
+func openVolumeStorages(root string, config *Storage) (map[int]*VolumeStorage, error) {
+	volumeStorages := map[int]*VolumeStorage{}
+	for _, v := range config.VolumeFileGroups {
+		volumepath := strings.Replace(v.Path, "{{DATA}}", root, 1)
+		vs, err := NewVolumeStorage(volumepath, config.VolumeSliceSize, config.DiskRemain)
+		if err != nil {
+			closeVolumeStorages(volumeStorages)
+			return nil, err
+		}
+		volumeStorages[v.Id] = vs
+	}
+	return volumeStorages, nil
+}
+
+func isSameRecord(a *VolumeRecord, b *VolumeRecord) bool {
+	return a.Kind == b.Kind && a.Timestamp == b.Timestamp && bytes.Equal(a.Hash, b.Hash)
+}
+
+func closeVolumeStorages(volumeStorages map[int]*VolumeStorage) {
+	for _, v := range volumeStorages {
+		v.Close()
+	}
+}
+
+// The latest record of every file path, and the location of every data.
+func collectVolumeRecords(config *Storage, volumeStorages map[int]*VolumeStorage) *volumeRecords {
+	result := &volumeRecords{
+		files:   map[string]*rebuildEntry{},
+		hashs:   map[string]*HashNode{},
+		groups:  map[string]map[int]*HashNode{},
+		skipped: []string{},
+	}
+	for _, v := range config.VolumeFileGroups {
+		volumeStorage := volumeStorages[v.Id]
+		for _, volumeId := range volumeStorage.VolumeIds() {
+			// The volume created by v1.0 has no record header
+			if volumeStorage.VolumeVersion(volumeId) == VolumeVersionRaw {
+				result.skipped = append(result.skipped, fmt.Sprintf("%d:volume-%d raw volume without records", v.Id, volumeId))
+				continue
+			}
+			result.volumes++
+			err := volumeStorage.WalkVolume(volumeId, func(record *VolumeRecord) error {
+				result.records++
+				if record.Kind == RecordKindData {
+					hnode := &HashNode{record.Size, v.Id, volumeId, record.Offset}
+					result.hashs[string(record.Hash)] = hnode
+					if result.groups[string(record.Hash)] == nil {
+						result.groups[string(record.Hash)] = map[int]*HashNode{}
+					}
+					result.groups[string(record.Hash)][v.Id] = hnode
+				}
+				if len(record.FilePath) < 1 {
+					return nil
+				}
+				entry := result.files[record.FilePath]
+				if entry == nil {
+					entry = &rebuildEntry{}
+					result.files[record.FilePath] = entry
+				}
+				// The replicas and the compacted copies are the same record, the
+				// other record not newer than the latest is a conflict
+				if latest := entry.record; latest != nil && record.Timestamp <= latest.Timestamp && !isSameRecord(latest, record) {
+					entry.conflicts++
+				}
+				if entry.record == nil || record.Timestamp >= entry.record.Timestamp {
+					entry.record = record
+				}
+				if config.VersionMax > 0 && record.Kind != RecordKindDelete && len(record.Extra) > 0 {
+					entry.versions = append(entry.versions, record)
+				}
+				return nil
+			})
+			if err != nil {
+				result.skipped = append(result.skipped, fmt.Sprintf("%d:volume-%d %s", v.Id, volumeId, err))
+			}
+		}
+	}
+	return result
+}
+
+// RebuildIndex walks every volume of the volume groups, and replaces the
+// index storage by the file paths recorded in volumes. The latest record
+// wins when the same file path recorded more than once.
+func RebuildIndex(root string, config *Storage) (*RebuildResult, error) {
+	dbpath := filepath.Join(root, "storage.db")
+	lock, err := lockIndexStorage(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockIndexStorage(lock)
+	volumeStorages, err := openVolumeStorages(root, config)
+	if err != nil {
+		return nil, err
+	}
+	defer closeVolumeStorages(volumeStorages)
+
+	records := collectVolumeRecords(config, volumeStorages)
+	files := records.files
+	hashs := records.hashs
+	result := &RebuildResult{
+		Volumes:   records.volumes,
+		Records:   records.records,
+		Missing:   []string{},
+		Skipped:   records.skipped,
+		Conflicts: []*RebuildConflict{},
+	}
+
+	// Write to temporary index storage, then replace
+	tmppath := dbpath + ".rebuild"
+	os.Remove(tmppath)
+	db, err := bolt.Open(tmppath, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		fbt, err := tx.CreateBucket(fileBucket)
+		if err != nil {
+			return err
+		}
+		hbt, err := tx.CreateBucket(hashBucket)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.CreateBucket(refsBucket); err != nil {
+			return err
+		}
+		ebt, err := tx.CreateBucket(expireBucket)
+		if err != nil {
+			return err
+		}
+		refs := map[string]int64{}
+		tbt, err := tx.CreateBucket(trashBucket)
+		if err != nil {
+			return err
+		}
+		vbt, err := tx.CreateBucket(versionBucket)
+		if err != nil {
+			return err
+		}
+		putVersions := func(path string, entry *rebuildEntry, current *FileNode) error {
+			vnodes, err := rebuildVersions(entry, current, hashs, config.VersionMax)
+			if err != nil {
+				return err
+			}
+			for _, vnode := range vnodes {
+				b, err := json.Marshal(vnode)
+				if err != nil {
+					return err
+				}
+				if err := vbt.Put(encodeVersionKey([]byte(path), vnode.versionId()), b); err != nil {
+					return err
+				}
+				refs[string(vnode.hashKey())]++
+			}
+			return nil
+		}
+		for k, hnode := range hashs {
+			b, err := json.Marshal(hnode)
+			if err != nil {
+				return err
+			}
+			if err := hbt.Put([]byte(k), b); err != nil {
+				return err
+			}
+		}
+		result.Hashs = len(hashs)
+
+		// The data in the other volume groups are the replicas
+		pbt, err := tx.CreateBucket(replicaBucket)
+		if err != nil {
+			return err
+		}
+		for k, groups := range records.groups {
+			replicas := []HashNode{}
+			for id, hnode := range groups {
+				if id != hashs[k].GroupId {
+					replicas = append(replicas, *hnode)
+				}
+			}
+			if len(replicas) < 1 {
+				continue
+			}
+			b, err := json.Marshal(replicas)
+			if err != nil {
+				return err
+			}
+			if err := pbt.Put([]byte(k), b); err != nil {
+				return err
+			}
+		}
+
+		for path, entry := range files {
+			if entry.conflicts > 0 {
+				result.Conflicts = append(result.Conflicts, &RebuildConflict{
+					FilePath:  path,
+					Count:     entry.conflicts,
+					Timestamp: entry.record.Timestamp,
+				})
+			}
+			record := entry.record
+			if record.Kind == RecordKindDelete {
+				result.Deleted++
+				// The trash node was kept in the record
+				if len(record.Extra) < 1 || hashs[string(record.Hash)] == nil {
+					continue
+				}
+				tnode := &FileNode{}
+				if err := json.Unmarshal(record.Extra, tnode); err != nil {
+					return err
+				}
+				if tnode.Deleted <= time.Now().Unix()-config.TrashRetention {
+					continue
+				}
+				tnode.HashNode = *hashs[string(record.Hash)]
+				tnode.Hash = hex.EncodeToString(record.Hash)
+				b, err := json.Marshal(tnode)
+				if err != nil {
+					return err
+				}
+				if err := tbt.Put([]byte(path), b); err != nil {
+					return err
+				}
+				refs[string(record.Hash)]++
+				if err := putVersions(path, entry, tnode); err != nil {
+					return err
+				}
+				continue
+			}
+			hnode := hashs[string(record.Hash)]
+			if hnode == nil {
+				result.Missing = append(result.Missing, path)
+				continue
+			}
+			fnode := &FileNode{}
+			if len(record.Extra) > 0 {
+				if err := json.Unmarshal(record.Extra, fnode); err != nil {
+					return err
+				}
+			} else {
+				fnode.Mime = record.Mime
+			}
+			fnode.HashNode = *hnode
+			fnode.Hash = hex.EncodeToString(record.Hash)
+			b, err := json.Marshal(fnode)
+			if err != nil {
+				return err
+			}
+			if err := fbt.Put([]byte(path), b); err != nil {
+				return err
+			}
+			if fnode.Expires > 0 {
+				if err := ebt.Put(encodeExpireKey(fnode.Expires, []byte(path)), []byte{}); err != nil {
+					return err
+				}
+			}
+			refs[string(record.Hash)]++
+			if err := putVersions(path, entry, fnode); err != nil {
+				return err
+			}
+			result.Files++
+		}
+		rbt := tx.Bucket(refsBucket)
+		for k, count := range refs {
+			if err := rbt.Put([]byte(k), encodeRefs(count)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		os.Remove(tmppath)
+		return nil, err
+	}
+	sort.Strings(result.Missing)
+	sort.Slice(result.Conflicts, func(i, j int) bool {
+		return result.Conflicts[i].FilePath < result.Conflicts[j].FilePath
+	})
+
+	backup, err := replaceIndexStorage(dbpath, tmppath)
+	if err != nil {
+		os.Remove(tmppath)
+		return nil, err
+	}
+	result.Backup = backup
+	return result, nil
+}
+
+// The versions of file path are restored from the data and link records,
+// except the current, the newest max versions are kept.
+func rebuildVersions(entry *rebuildEntry, current *FileNode, hashs map[string]*HashNode, max int) ([]*FileNode, error) {
+	vnodes := map[int64]*FileNode{}
+	for _, record := range entry.versions {
+		hnode := hashs[string(record.Hash)]
+		if hnode == nil {
+			continue
+		}
+		vnode := &FileNode{}
+		if err := json.Unmarshal(record.Extra, vnode); err != nil {
+			return nil, err
+		}
+		if vnode.versionId() == current.versionId() {
+			continue
+		}
+		vnode.HashNode = *hnode
+		vnode.Hash = hex.EncodeToString(record.Hash)
+		vnode.Expires = 0
+		vnodes[vnode.versionId()] = vnode
+	}
+	result := make([]*FileNode, 0, len(vnodes))
+	for _, vnode := range vnodes {
+		result = append(result, vnode)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].versionId() > result[j].versionId()
+	})
+	if len(result) > max {
+		result = result[:max]
+	}
+	return result, nil
+}
@@ -0,0 +1,198 @@
+package tinynfs
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	bolt "github.com/etcd-io/bbolt"
+	"time"
+)
+
+type HashStat struct {
+	HashNode
+	Hash string `json:"hash"`
+	Refs int64  `json:"refs"`
+
+	Replicas []HashNode `json:"replicas"`
+}
+
+type RepairResult struct {
+	Files   int `json:"files"`
+	Hashs   int `json:"hashs"`
+	Fixed   int `json:"fixed"`
+	Orphans int `json:"orphans"`
+}
+
+func (self *FileSystem) txReadRefs(tx *bolt.Tx, hashkey []byte) int64 {
+	v := tx.Bucket(refsBucket).Get(hashkey)
+	if len(v) != 8 {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(v))
+}
+
+func (self *FileSystem) txWriteRefs(tx *bolt.Tx, hashkey []byte, refs int64) error {
+	bt := tx.Bucket(refsBucket)
+	if refs <= 0 {
+		return bt.Delete(hashkey)
+	}
+	return bt.Put(hashkey, encodeRefs(refs))
+}
+
+func encodeRefs(refs int64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(refs))
+	return b
+}
+
+func (self *FileSystem) txUpdateRefs(tx *bolt.Tx, hashkey []byte, delta int64) error {
+	if hashkey == nil {
+		return nil
+	}
+	return self.txWriteRefs(tx, hashkey, self.txReadRefs(tx, hashkey)+delta)
+}
+
+func (self *FileSystem) StatHash(hash string) (*HashStat, error) {
+	hashkey, err := hex.DecodeString(hash)
+	if err != nil {
+		return nil, ErrParam
+	}
+	var hstat *HashStat
+	err = self.storageDB.View(func(tx *bolt.Tx) error {
+		var hnode *HashNode
+		if err := self.txReadNode(tx, hashBucket, hashkey, &hnode); err != nil {
+			return err
+		}
+		if hnode == nil {
+			return ErrNotExist
+		}
+		replicas, err := self.txReadReplicas(tx, hashkey)
+		if err != nil {
+			return err
+		}
+		hstat = &HashStat{
+			HashNode: *hnode,
+			Hash:     hex.EncodeToString(hashkey),
+			Refs:     self.txReadRefs(tx, hashkey),
+			Replicas: replicas,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return hstat, nil
+}
+
+func (self *FileSystem) RepairRefs() (*RepairResult, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return nil, err
+	}
+
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+
+	result := &RepairResult{}
+	err := self.storageDB.Update(func(tx *bolt.Tx) error {
+		// Hash key of the file node created by old version
+		locations := map[HashNode][]byte{}
+		err := tx.Bucket(hashBucket).ForEach(func(k, v []byte) error {
+			var hnode HashNode
+			if err := json.Unmarshal(v, &hnode); err != nil {
+				return err
+			}
+			locations[hnode] = append([]byte{}, k...)
+			result.Hashs++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		counts := map[string]int64{}
+		fnodes := map[string]*FileNode{}
+		err = tx.Bucket(fileBucket).ForEach(func(k, v []byte) error {
+			var fnode FileNode
+			if err := json.Unmarshal(v, &fnode); err != nil {
+				return err
+			}
+			result.Files++
+			hashkey := fnode.hashKey()
+			if hashkey == nil {
+				hashkey = locations[fnode.HashNode]
+				if hashkey == nil {
+					return nil
+				}
+				fnode.Hash = hex.EncodeToString(hashkey)
+				fnodes[string(k)] = &fnode
+			}
+			counts[string(hashkey)]++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, fnode := range fnodes {
+			if err := self.txWriteNode(tx, fileBucket, []byte(k), fnode); err != nil {
+				return err
+			}
+		}
+		// The nodes out of file bucket hold the references too
+		for _, bucket := range nodeBuckets[1:] {
+			err := tx.Bucket(bucket).ForEach(func(k, v []byte) error {
+				var fnode FileNode
+				if err := json.Unmarshal(v, &fnode); err != nil {
+					return err
+				}
+				if hashkey := fnode.hashKey(); hashkey != nil {
+					counts[string(hashkey)]++
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// Rewrite the different counts
+		stales := [][]byte{}
+		err = tx.Bucket(refsBucket).ForEach(func(k, v []byte) error {
+			if _, ok := counts[string(k)]; !ok {
+				stales = append(stales, append([]byte{}, k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range stales {
+			if err := self.txWriteRefs(tx, k, 0); err != nil {
+				return err
+			}
+			result.Fixed++
+		}
+		for k, refs := range counts {
+			hashkey := []byte(k)
+			if self.txReadRefs(tx, hashkey) == refs {
+				continue
+			}
+			if err := self.txWriteRefs(tx, hashkey, refs); err != nil {
+				return err
+			}
+			result.Fixed++
+		}
+		for _, hashkey := range locations {
+			if _, ok := counts[string(hashkey)]; !ok {
+				result.Orphans++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result.Fixed > 0 {
+		self.timeOnUpdate = time.Now().Unix()
+	}
+	return result, nil
+}
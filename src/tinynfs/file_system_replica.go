@@ -0,0 +1,279 @@
+package tinynfs
+
+import (
+	"encoding/json"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"log"
+	"time"
+)
+
+type ReplicaResult struct {
+	Hashs    int `json:"hashs"`
+	Created  int `json:"created"`
+	Promoted int `json:"promoted"`
+	Lost     int `json:"lost"`
+}
+
+type replicaRepair struct {
+	hashkey  []byte
+	primary  HashNode
+	healthy  []HashNode
+	promoted bool
+}
+
+// The replicas of data are kept by the hash, except the primary location in
+// hash bucket, the file nodes always link to the primary.
+func (self *FileSystem) txReadReplicas(tx *bolt.Tx, hashkey []byte) ([]HashNode, error) {
+	replicas := []HashNode{}
+	if v := tx.Bucket(replicaBucket).Get(hashkey); v != nil {
+		if err := json.Unmarshal(v, &replicas); err != nil {
+			return nil, err
+		}
+	}
+	return replicas, nil
+}
+
+func (self *FileSystem) txWriteReplicas(tx *bolt.Tx, hashkey []byte, replicas []HashNode) error {
+	if len(replicas) < 1 {
+		return tx.Bucket(replicaBucket).Delete(hashkey)
+	}
+	return self.txWriteNode(tx, replicaBucket, hashkey, replicas)
+}
+
+func (self *FileSystem) replicaCount() int {
+	if self.config.VolumeReplicas < 1 {
+		return 1
+	}
+	return self.config.VolumeReplicas
+}
+
+// The locations of data, the node location first, then the primary and the
+// replicas.
+func (self *FileSystem) readLocations(hashkey []byte, hnode *HashNode) []HashNode {
+	locations := []HashNode{*hnode}
+	if hashkey == nil {
+		return locations
+	}
+	self.storageDB.View(func(tx *bolt.Tx) error {
+		var primary *HashNode
+		if err := self.txReadNode(tx, hashBucket, hashkey, &primary); err != nil {
+			return err
+		}
+		if primary != nil && *primary != *hnode {
+			locations = append(locations, *primary)
+		}
+		replicas, err := self.txReadReplicas(tx, hashkey)
+		if err != nil {
+			return err
+		}
+		for _, v := range replicas {
+			if v != *hnode {
+				locations = append(locations, v)
+			}
+		}
+		return nil
+	})
+	return locations
+}
+
+func (self *FileSystem) isHealthy(hashkey []byte, hnode *HashNode) bool {
+	volumeStorage := self.volumeStorages[hnode.GroupId]
+	if volumeStorage == nil || volumeStorage.getVolume(hnode.VolumeId) == nil {
+		return false
+	}
+	return !self.isCorrupted(hashkey, hnode)
+}
+
+// Copy the data to the writable volume of the group
+func (self *FileSystem) copyReplica(hashkey []byte, src *HashNode, groupId int) (*HashNode, error) {
+	srcStorage := self.volumeStorages[src.GroupId]
+	dstStorage := self.volumeStorages[groupId]
+	if srcStorage == nil || dstStorage == nil {
+		return nil, ErrNotExist
+	}
+	reader, err := srcStorage.OpenFile(src.VolumeId, src.VolumeOffset, src.Size)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// The replica record has no file path, it is not a file for index rebuilding
+	record := &VolumeRecord{
+		Kind: RecordKindData,
+		Hash: hashkey,
+	}
+	volumeId, volumeOffset, err := dstStorage.WriteFrom(reader, int64(src.Size), record)
+	if err != nil {
+		return nil, err
+	}
+	return &HashNode{src.Size, groupId, volumeId, volumeOffset}, nil
+}
+
+// writeReplicas copies the new written data to the other volume groups, the
+// missing replicas are created by repairing later.
+func (self *FileSystem) writeReplicas(filepath string, hashkey []byte, hnode *HashNode) []HashNode {
+	replicas := []HashNode{}
+	used := map[int]bool{hnode.GroupId: true}
+	for len(replicas)+1 < self.replicaCount() {
+		groupId, _ := self.selectReplicaStorage(filepath, used)
+		if groupId < 0 {
+			log.Println(fmt.Sprintf("replica of %x missing: %s", hashkey, ErrVolumeStorageFully))
+			break
+		}
+		used[groupId] = true
+		replica, err := self.copyReplica(hashkey, hnode, groupId)
+		if err != nil {
+			log.Println(fmt.Sprintf("replica of %x missing: %s", hashkey, err))
+			continue
+		}
+		replicas = append(replicas, *replica)
+	}
+	return replicas
+}
+
+func (self *FileSystem) selectReplicaStorage(filepath string, used map[int]bool) (int, *VolumeStorage) {
+	return self.placeVolumeGroup(filepath, used)
+}
+
+// RepairReplicas re-creates the missing or corrupted replicas of every live
+// data from a healthy location, the healthy replica is promoted to primary
+// when the primary was lost.
+func (self *FileSystem) RepairReplicas() (*ReplicaResult, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return nil, err
+	}
+
+	self.compactLock.Lock()
+	defer self.compactLock.Unlock()
+
+	result := &ReplicaResult{}
+	repairs := []*replicaRepair{}
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(hashBucket).ForEach(func(k, v []byte) error {
+			if self.txReadRefs(tx, k) < 1 {
+				return nil
+			}
+			var primary HashNode
+			if err := json.Unmarshal(v, &primary); err != nil {
+				return err
+			}
+			replicas, err := self.txReadReplicas(tx, k)
+			if err != nil {
+				return err
+			}
+			result.Hashs++
+			repairs = append(repairs, &replicaRepair{
+				hashkey: append([]byte{}, k...),
+				primary: primary,
+				healthy: append([]HashNode{primary}, replicas...),
+			})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	changes := []*replicaRepair{}
+	for _, repair := range repairs {
+		healthy := []HashNode{}
+		used := map[int]bool{}
+		for _, hnode := range repair.healthy {
+			if !used[hnode.GroupId] && self.isHealthy(repair.hashkey, &hnode) {
+				healthy = append(healthy, hnode)
+				used[hnode.GroupId] = true
+			}
+		}
+		if len(healthy) < 1 {
+			log.Println(fmt.Sprintf("replica of %x lost", repair.hashkey))
+			result.Lost++
+			continue
+		}
+		created := 0
+		for len(healthy) < self.replicaCount() {
+			groupId, _ := self.selectReplicaStorage("", used)
+			if groupId < 0 {
+				break
+			}
+			used[groupId] = true
+			replica, err := self.copyReplica(repair.hashkey, &healthy[0], groupId)
+			if err != nil {
+				log.Println(fmt.Sprintf("replica of %x missing: %s", repair.hashkey, err))
+				continue
+			}
+			healthy = append(healthy, *replica)
+			created++
+		}
+		changed := created > 0 || len(healthy) != len(repair.healthy)
+		if healthy[0] != repair.primary {
+			repair.promoted = true
+		}
+		if changed || repair.promoted {
+			repair.healthy = healthy
+			changes = append(changes, repair)
+			result.Created += created
+		}
+	}
+	if len(changes) < 1 {
+		return result, nil
+	}
+
+	// Switch the nodes to the promoted primary
+	self.writeLock.Lock()
+	defer self.writeLock.Unlock()
+	err = self.storageDB.Update(func(tx *bolt.Tx) error {
+		promotes := map[HashNode]HashNode{}
+		for _, repair := range changes {
+			var primary *HashNode
+			if err := self.txReadNode(tx, hashBucket, repair.hashkey, &primary); err != nil {
+				return err
+			}
+			if primary == nil || *primary != repair.primary {
+				continue
+			}
+			if repair.promoted {
+				if err := self.txWriteNode(tx, hashBucket, repair.hashkey, &repair.healthy[0]); err != nil {
+					return err
+				}
+				promotes[repair.primary] = repair.healthy[0]
+				result.Promoted++
+			}
+			if err := self.txWriteReplicas(tx, repair.hashkey, repair.healthy[1:]); err != nil {
+				return err
+			}
+		}
+		if len(promotes) < 1 {
+			return nil
+		}
+		for _, bucket := range nodeBuckets {
+			bt := tx.Bucket(bucket)
+			fnodes := map[string]*FileNode{}
+			err := bt.ForEach(func(k, v []byte) error {
+				var fnode FileNode
+				if err := json.Unmarshal(v, &fnode); err != nil {
+					return err
+				}
+				if hnode, ok := promotes[fnode.HashNode]; ok {
+					fnode.HashNode = hnode
+					fnodes[string(k)] = &fnode
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			for k, fnode := range fnodes {
+				if err := self.txWriteNode(tx, bucket, []byte(k), fnode); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	self.timeOnUpdate = time.Now().Unix()
+	return result, nil
+}
@@ -0,0 +1,204 @@
+package tinynfs
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type SnapshotInfo struct {
+	Name      string `json:"name"`
+	Size      int64  `json:"size"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type RestoreResult struct {
+	Snapshot    string   `json:"snapshot"`
+	Files       int      `json:"files"`
+	Missing     []string `json:"missing"`
+	Resurrected []string `json:"resurrected"`
+	Unreachable []string `json:"unreachable"`
+	Skipped     []string `json:"skipped"`
+	Backup      string   `json:"backup"`
+}
+
+func ListSnapshots(root string) ([]*SnapshotInfo, error) {
+	ssfiles, err := ioutil.ReadDir(filepath.Join(root, "snapshots"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []*SnapshotInfo{}, nil
+		}
+		return nil, err
+	}
+	snapshots := []*SnapshotInfo{}
+	for _, file := range ssfiles {
+		name := file.Name()
+		if m, _ := regexp.MatchString("^storage\\.db\\.[0-9]+\\.gz$", name); !m {
+			continue
+		}
+		nanos, err := strconv.ParseInt(strings.Split(name, ".")[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, &SnapshotInfo{
+			Name:      name,
+			Size:      file.Size(),
+			Timestamp: nanos,
+		})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].Timestamp < snapshots[j].Timestamp
+	})
+	return snapshots, nil
+}
+
+func unzipSnapshot(sspath string, dbpath string) error {
+	gzfile, err := os.Open(sspath)
+	if err != nil {
+		return err
+	}
+	defer gzfile.Close()
+	reader, err := gzip.NewReader(gzfile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	dbfile, err := os.OpenFile(dbpath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(dbfile, reader)
+	if err == nil {
+		err = dbfile.Sync()
+	}
+	dbfile.Close()
+	return err
+}
+
+// RestoreSnapshot replaces the index storage by the snapshot, then reports
+// the file paths changed in volumes after the snapshot.
+func RestoreSnapshot(root string, config *Storage, name string) (*RestoreResult, error) {
+	snapshots, err := ListSnapshots(root)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot *SnapshotInfo
+	for _, v := range snapshots {
+		if v.Name == name {
+			snapshot = v
+		}
+	}
+	if snapshot == nil {
+		return nil, ErrNotExist
+	}
+
+	dbpath := filepath.Join(root, "storage.db")
+	lock, err := lockIndexStorage(dbpath)
+	if err != nil {
+		return nil, err
+	}
+	defer unlockIndexStorage(lock)
+	volumeStorages, err := openVolumeStorages(root, config)
+	if err != nil {
+		return nil, err
+	}
+	defer closeVolumeStorages(volumeStorages)
+
+	tmppath := dbpath + ".restore"
+	if err := unzipSnapshot(filepath.Join(root, "snapshots", name), tmppath); err != nil {
+		os.Remove(tmppath)
+		return nil, err
+	}
+	db, err := bolt.Open(tmppath, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		os.Remove(tmppath)
+		return nil, err
+	}
+
+	records := collectVolumeRecords(config, volumeStorages)
+	result := &RestoreResult{
+		Snapshot:    name,
+		Missing:     []string{},
+		Resurrected: []string{},
+		Unreachable: []string{},
+		Skipped:     records.skipped,
+	}
+	err = db.View(func(tx *bolt.Tx) error {
+		// The checker stops after every error was received
+		var cerr error
+		for err := range tx.Check() {
+			if cerr == nil {
+				cerr = err
+			}
+		}
+		if cerr != nil {
+			return cerr
+		}
+		fbt := tx.Bucket(fileBucket)
+		if fbt == nil || tx.Bucket(hashBucket) == nil {
+			return fmt.Errorf("snapshot %s: bucket not found", name)
+		}
+		err := fbt.ForEach(func(k, v []byte) error {
+			var fnode FileNode
+			if err := json.Unmarshal(v, &fnode); err != nil {
+				return err
+			}
+			result.Files++
+			// The volume maybe removed by compaction after the snapshot
+			volumeStorage := volumeStorages[fnode.GroupId]
+			if volumeStorage == nil || volumeStorage.getVolume(fnode.VolumeId) == nil {
+				result.Unreachable = append(result.Unreachable, string(k))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for path, entry := range records.files {
+			record := entry.record
+			if record.Timestamp <= snapshot.Timestamp {
+				continue
+			}
+			var fnode *FileNode
+			if v := fbt.Get([]byte(path)); v != nil {
+				if err := json.Unmarshal(v, &fnode); err != nil {
+					return err
+				}
+			}
+			if record.Kind == RecordKindDelete {
+				if fnode != nil {
+					result.Resurrected = append(result.Resurrected, path)
+				}
+			} else if fnode == nil || (fnode.Hash != "" && !isSameHash(fnode.hashKey(), record.Hash)) {
+				result.Missing = append(result.Missing, path)
+			}
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		os.Remove(tmppath)
+		return nil, err
+	}
+	sort.Strings(result.Missing)
+	sort.Strings(result.Resurrected)
+	sort.Strings(result.Unreachable)
+
+	backup, err := replaceIndexStorage(dbpath, tmppath)
+	if err != nil {
+		os.Remove(tmppath)
+		return nil, err
+	}
+	result.Backup = backup
+	return result, nil
+}
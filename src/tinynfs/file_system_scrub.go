@@ -0,0 +1,223 @@
+package tinynfs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	bolt "github.com/etcd-io/bbolt"
+	"io"
+	"log"
+	"time"
+)
+
+const (
+	scrubChunkSize = 1024 * 1024
+)
+
+type CorruptNode struct {
+	HashNode
+	Hash     string `json:"hash"`
+	Detected int64  `json:"detected"`
+}
+
+type ScrubResult struct {
+	Hashs     int   `json:"hashs"`
+	Bytes     int64 `json:"bytes"`
+	Corrupted int   `json:"corrupted"`
+	Started   int64 `json:"started"`
+	Finished  int64 `json:"finished"`
+}
+
+// The key of corrupts bucket is the hash then the location, every replica
+// of the data is quarantined alone.
+func encodeCorruptKey(hashkey []byte, hnode *HashNode) []byte {
+	key := make([]byte, len(hashkey)+24)
+	copy(key, hashkey)
+	binary.BigEndian.PutUint64(key[len(hashkey):], uint64(hnode.GroupId))
+	binary.BigEndian.PutUint64(key[len(hashkey)+8:], uint64(hnode.VolumeId))
+	binary.BigEndian.PutUint64(key[len(hashkey)+16:], uint64(hnode.VolumeOffset))
+	return key
+}
+
+// The reading of the quarantined data fails before sending
+func (self *FileSystem) isCorrupted(hashkey []byte, hnode *HashNode) bool {
+	if hashkey == nil {
+		return false
+	}
+	var cnode *CorruptNode
+	if err := self.readNode(corruptBucket, encodeCorruptKey(hashkey, hnode), &cnode); err != nil {
+		return false
+	}
+	return cnode != nil
+}
+
+func (self *FileSystem) quarantine(hashkey []byte, hnode *HashNode) {
+	log.Println(fmt.Sprintf("volume data corrupted %x at %d:volume-%d:%d", hashkey, hnode.GroupId, hnode.VolumeId, hnode.VolumeOffset))
+	self.storageDB.Update(func(tx *bolt.Tx) error {
+		return self.txWriteNode(tx, corruptBucket, encodeCorruptKey(hashkey, hnode), &CorruptNode{
+			HashNode: *hnode,
+			Hash:     hex.EncodeToString(hashkey),
+			Detected: time.Now().Unix(),
+		})
+	})
+}
+
+func (self *FileSystem) ListCorrupted() ([]*CorruptNode, error) {
+	cnodes := []*CorruptNode{}
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(corruptBucket).ForEach(func(k, v []byte) error {
+			var cnode CorruptNode
+			if err := json.Unmarshal(v, &cnode); err != nil {
+				return err
+			}
+			cnodes = append(cnodes, &cnode)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cnodes, nil
+}
+
+// ScrubStatus returns whether the scrub is running, and the result of last
+func (self *FileSystem) ScrubStatus() (bool, *ScrubResult) {
+	self.scrubLock.Lock()
+	defer self.scrubLock.Unlock()
+
+	return self.scrubbing, self.scrubResult
+}
+
+func (self *FileSystem) lockScrub() error {
+	self.scrubLock.Lock()
+	defer self.scrubLock.Unlock()
+
+	if self.scrubbing {
+		return ErrScrubBusy
+	}
+	self.scrubbing = true
+	self.timeOnScrub = time.Now().Unix()
+	return nil
+}
+
+// Scrub verifies the data of every live hash node by its sha256, the data
+// was read in the rate limit.
+func (self *FileSystem) Scrub(force bool) (*ScrubResult, error) {
+	if !force {
+		if self.config.ScrubInterval <= 0 {
+			return nil, nil
+		}
+		if self.timeOnScrub+self.config.ScrubInterval > time.Now().Unix() {
+			return nil, nil
+		}
+	}
+	if err := self.lockScrub(); err != nil {
+		return nil, err
+	}
+	return self.scrub()
+}
+
+// StartScrub runs the scrub in background
+func (self *FileSystem) StartScrub() error {
+	if err := self.lockScrub(); err != nil {
+		return err
+	}
+	go self.scrub()
+	return nil
+}
+
+func (self *FileSystem) scrub() (*ScrubResult, error) {
+	result := &ScrubResult{
+		Started: time.Now().Unix(),
+	}
+	defer func() {
+		result.Finished = time.Now().Unix()
+		self.scrubLock.Lock()
+		self.scrubbing = false
+		self.scrubResult = result
+		self.scrubLock.Unlock()
+	}()
+
+	hashkeys := [][]byte{}
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(hashBucket).ForEach(func(k, v []byte) error {
+			if self.txReadRefs(tx, k) > 0 {
+				hashkeys = append(hashkeys, append([]byte{}, k...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	started := time.Now()
+	throttle := func(n int64) {
+		result.Bytes += n
+		if self.config.ScrubRate <= 0 {
+			return
+		}
+		expected := time.Duration(result.Bytes * int64(time.Second) / self.config.ScrubRate)
+		if elapsed := time.Since(started); elapsed < expected {
+			time.Sleep(expected - elapsed)
+		}
+	}
+	for _, hashkey := range hashkeys {
+		// The location maybe changed by compaction
+		var hnode *HashNode
+		if err := self.readNode(hashBucket, hashkey, &hnode); err != nil {
+			return nil, err
+		}
+		if hnode == nil {
+			continue
+		}
+		result.Hashs++
+		for _, location := range self.readLocations(hashkey, hnode) {
+			ok, err := self.verifyHashNode(hashkey, &location, throttle)
+			if err == ErrNotExist {
+				continue
+			}
+			if err != nil || !ok {
+				result.Corrupted++
+				self.quarantine(hashkey, &location)
+			} else if self.isCorrupted(hashkey, &location) {
+				// Release the quarantine of the repaired data
+				self.storageDB.Update(func(tx *bolt.Tx) error {
+					return tx.Bucket(corruptBucket).Delete(encodeCorruptKey(hashkey, &location))
+				})
+			}
+		}
+	}
+	if self.replicaCount() > 1 && !self.IsReadOnly() {
+		if _, err := self.RepairReplicas(); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+func (self *FileSystem) verifyHashNode(hashkey []byte, hnode *HashNode, throttle func(n int64)) (bool, error) {
+	volumeStorage := self.volumeStorages[hnode.GroupId]
+	if volumeStorage == nil {
+		return false, ErrNotExist
+	}
+	reader, err := volumeStorage.OpenFile(hnode.VolumeId, hnode.VolumeOffset, hnode.Size)
+	if err != nil {
+		return false, err
+	}
+	defer reader.Close()
+
+	hash := sha256.New()
+	for {
+		n, err := io.CopyN(hash, reader, scrubChunkSize)
+		throttle(n)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return false, err
+		}
+	}
+	return isSameHash(hashkey, hash.Sum(nil)), nil
+}
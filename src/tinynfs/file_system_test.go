@@ -1,8 +1,16 @@
 package tinynfs
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	bolt "github.com/etcd-io/bbolt"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 var (
@@ -50,3 +58,934 @@ func TestFileSystem(t *testing.T) {
 		t.Log("Snapshot file success: " + ssfile)
 	}
 }
+
+func TestFileSystemCompact(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-compact"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		CompactThreshold: 50,
+		VolumeSliceSize:  int64(len(fsTestBuffer)),
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	if err := fs.WriteFile("/compact/a", "", "", []byte("compact deleted file"), nil); err != nil {
+		t.Error("Write file error", err)
+	}
+	if err := fs.WriteFile("/compact/b", "", "", fsTestBuffer, nil); err != nil {
+		t.Error("Write file error", err)
+	}
+	if err := fs.DeleteFile("/compact/a"); err != nil {
+		t.Error("Delete file error", err)
+	}
+	results, err := fs.Compact(true)
+	if err != nil {
+		t.Error("Compact error", err)
+	} else if len(results) < 1 {
+		t.Error("Compact nothing")
+	} else {
+		t.Logf("Compact success: %d volumes", len(results))
+	}
+	_, _, data, err := fs.ReadFile("/compact/b")
+	if err != nil {
+		t.Error("Read file error", err)
+	} else if string(data) != string(fsTestBuffer) {
+		t.Error("Read file mismatch: " + string(data))
+	}
+
+	// The node not copied without the write lock is not switched
+	fnode, err := fs.Stat("/compact/b")
+	if err != nil {
+		t.Fatal("Stat error", err)
+	}
+	inVolume := func(node *HashNode) bool {
+		return node.GroupId == fnode.GroupId && node.VolumeId == fnode.VolumeId
+	}
+	err = fs.storageDB.Update(func(tx *bolt.Tx) error {
+		return fs.txCompactSwitch(tx, inVolume, map[int64]*HashNode{})
+	})
+	if err != errCompactChanged {
+		t.Error("Compact switch uncopied node", err)
+	}
+	if _, _, _, err := fs.ReadFile("/compact/b"); err != nil {
+		t.Error("Read file error", err)
+	}
+}
+
+func TestFileSystemRefs(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-refs"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	hashtmp := sha256.Sum256(fsTestBuffer)
+	hash := hex.EncodeToString(hashtmp[:])
+	fs.WriteFile("/refs/a", "", "", fsTestBuffer, nil)
+	fs.WriteFile("/refs/b", "", "", fsTestBuffer, nil)
+	fs.WriteFile("/refs/c", "", "", fsTestBuffer, nil)
+	fs.WriteFile("/refs/c", "", "", []byte("overwrite refs"), nil)
+	fs.DeleteFile("/refs/b")
+	hstat, err := fs.StatHash(hash)
+	if err != nil {
+		t.Error("Stat hash error", err)
+	} else if hstat.Refs != 1 {
+		t.Errorf("Stat hash refs: %d", hstat.Refs)
+	}
+	result, err := fs.RepairRefs()
+	if err != nil {
+		t.Error("Repair refs error", err)
+	} else if result.Fixed != 0 {
+		t.Errorf("Repair refs fixed: %d", result.Fixed)
+	} else {
+		t.Logf("Repair refs success: %d files, %d hashs, %d orphans", result.Files, result.Hashs, result.Orphans)
+	}
+}
+
+func TestRebuildIndex(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-rebuild")
+	config := &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	}
+	fs, err := NewFileSystem(root, config)
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	fs.WriteFile("/rebuild/a", "text/plain", "", fsTestBuffer, nil)
+	fs.WriteFile("/rebuild/b", "text/plain", "1x1", fsTestBuffer, nil)
+	fs.WriteFile("/rebuild/c", "", "", []byte("rebuild deleted file"), nil)
+	fs.DeleteFile("/rebuild/c")
+	fs.Close()
+	// The raw volume created by v1.0
+	if err := ioutil.WriteFile(filepath.Join(root, "volumes", "volume-1530000000000000001"), fsTestBuffer, 0644); err != nil {
+		t.Fatal("Write raw volume error", err)
+	}
+
+	result, err := RebuildIndex(root, config)
+	if err != nil {
+		t.Fatal("Rebuild index error", err)
+	}
+	if len(result.Conflicts) != 0 {
+		t.Errorf("Rebuild index conflicts: %d", len(result.Conflicts))
+	}
+	if len(result.Skipped) != 1 || !strings.Contains(result.Skipped[0], "raw volume") {
+		t.Errorf("Rebuild index skipped: %v", result.Skipped)
+	}
+	t.Logf("Rebuild index success: %d files, %d hashs, %d conflicts", result.Files, result.Hashs, len(result.Conflicts))
+
+	fs, err = NewFileSystem(root, config)
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+	_, metadata, data, err := fs.ReadFile("/rebuild/b")
+	if err != nil {
+		t.Error("Read file error", err)
+	} else if metadata != "1x1" || string(data) != string(fsTestBuffer) {
+		t.Error("Read file mismatch: " + metadata)
+	}
+	if _, _, _, err := fs.ReadFile("/rebuild/c"); err != ErrNotExist {
+		t.Error("Read deleted file", err)
+	}
+}
+
+func TestRestoreSnapshot(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-restore")
+	config := &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	}
+	fs, err := NewFileSystem(root, config)
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	fs.WriteFile("/restore/a", "", "", fsTestBuffer, nil)
+	ssfile, err := fs.Snapshot(true)
+	if err != nil {
+		t.Fatal("Snapshot error", err)
+	}
+	fs.WriteFile("/restore/b", "", "", []byte("restore missing file"), nil)
+	if _, err := RestoreSnapshot(root, config, ssfile); err != ErrIndexStorageBusy {
+		t.Error("Restore opened index storage", err)
+	}
+	fs.Close()
+
+	snapshots, err := ListSnapshots(root)
+	if err != nil || len(snapshots) < 1 {
+		t.Fatal("List snapshots error", err)
+	}
+	result, err := RestoreSnapshot(root, config, ssfile)
+	if err != nil {
+		t.Fatal("Restore snapshot error", err)
+	}
+	found := false
+	for _, v := range result.Missing {
+		if v == "/restore/b" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("Restore snapshot missing not reported")
+	} else {
+		t.Logf("Restore snapshot success: %d files, %d missing", result.Files, len(result.Missing))
+	}
+}
+
+func TestFileSystemStream(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-stream"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	size, err := fs.WriteStream("/stream/a", "text/plain", "", bytes.NewReader(fsTestBuffer), nil)
+	if err != nil {
+		t.Fatal("Write stream error", err)
+	} else if size != int64(len(fsTestBuffer)) {
+		t.Errorf("Write stream size: %d", size)
+	}
+	fnode, err := fs.Stat("/stream/a")
+	if err != nil {
+		t.Error("Stat file error", err)
+	} else if fnode.Size != len(fsTestBuffer) || fnode.Mime != "text/plain" {
+		t.Errorf("Stat file mismatch: %d %s", fnode.Size, fnode.Mime)
+	}
+	if _, err := fs.Stat("/stream/none"); err != ErrNotExist {
+		t.Error("Stat missing file", err)
+	}
+	file, err := fs.OpenFile("/stream/a")
+	if err != nil {
+		t.Fatal("Open file error", err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Error("Read stream error", err)
+	} else if string(data) != string(fsTestBuffer) {
+		t.Error("Read stream mismatch: " + string(data))
+	} else {
+		t.Log("Read stream success: " + file.Node.Mime + " - " + string(data))
+	}
+}
+
+func TestFileSystemList(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-list"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	for _, v := range []string{"/list/a", "/list/b/1", "/list/b/2", "/list/c", "/listx"} {
+		if err := fs.WriteFile(v, "text/plain", "", fsTestBuffer, nil); err != nil {
+			t.Fatal("Write file error", err)
+		}
+	}
+	options := &WriteOptions{
+		Overwrite: true,
+		Meta:      map[string]string{"uploader": "tester"},
+	}
+	if err := fs.WriteFile("/list/c", "text/plain", "", fsTestBuffer, options); err != nil {
+		t.Fatal("Write file with meta error", err)
+	}
+	result, err := fs.List("/list/", "/", "", 0)
+	if err != nil {
+		t.Fatal("List error", err)
+	} else if len(result.Files) != 2 || len(result.Prefixes) != 1 || result.Prefixes[0] != "/list/b/" {
+		t.Errorf("List mismatch: %d files, %v", len(result.Files), result.Prefixes)
+	} else if result.Files[1].Meta["uploader"] != "tester" {
+		t.Errorf("List meta mismatch: %v", result.Files[1].Meta)
+	}
+	paths := []string{}
+	cursor := ""
+	for {
+		result, err := fs.List("/list/", "", cursor, 2)
+		if err != nil {
+			t.Fatal("List page error", err)
+		}
+		for _, v := range result.Files {
+			paths = append(paths, v.FilePath)
+		}
+		if cursor = result.Cursor; len(cursor) < 1 {
+			break
+		}
+	}
+	if strings.Join(paths, ",") != "/list/a,/list/b/1,/list/b/2,/list/c" {
+		t.Error("List pages mismatch: " + strings.Join(paths, ","))
+	} else {
+		t.Log("List pages success: " + strings.Join(paths, ","))
+	}
+}
+
+func TestFileSystemMove(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-move")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	for _, v := range []string{"/move/a", "/move/dir/1", "/move/dir/2"} {
+		if err := fs.WriteFile(v, "text/plain", "", fsTestBuffer, nil); err != nil {
+			t.Fatal("Write file error", err)
+		}
+	}
+	if err := fs.Copy("/move/a", "/move/b", false); err != nil {
+		t.Error("Copy error", err)
+	}
+	if err := fs.Rename("/move/a", "/move/b", false); err != ErrExist {
+		t.Error("Rename to exists file", err)
+	}
+	if err := fs.Rename("/move/a", "/move/c", false); err != nil {
+		t.Error("Rename error", err)
+	}
+	if _, err := fs.Stat("/move/a"); err != ErrNotExist {
+		t.Error("Rename source exists", err)
+	}
+	if n, err := fs.RenamePrefix("/move/dir/", "/move/new/", false); err != nil || n != 2 {
+		t.Error("Rename prefix error", n, err)
+	}
+	hash := sha256.Sum256(fsTestBuffer)
+	hstat, err := fs.StatHash(hex.EncodeToString(hash[:]))
+	if err != nil {
+		t.Error("Stat hash error", err)
+	} else if hstat.Refs != 4 {
+		t.Errorf("Refs mismatch: %d", hstat.Refs)
+	} else {
+		t.Logf("Move success, refs: %d", hstat.Refs)
+	}
+}
+
+func TestFileSystemUpload(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-upload")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	session, err := fs.CreateUpload("/upload/a", "text/plain", "", int64(len(fsTestBuffer)), nil)
+	if err != nil {
+		t.Fatal("Create upload error", err)
+	}
+	if _, err := fs.WriteUpload(session.Id, 0, bytes.NewReader(fsTestBuffer[:5])); err != nil {
+		t.Error("Write chunk error", err)
+	}
+	if _, err := fs.WriteUpload(session.Id, 0, bytes.NewReader(fsTestBuffer[5:])); err != ErrUploadConflict {
+		t.Error("Write chunk with wrong offset", err)
+	}
+	if _, err := fs.CommitUpload(session.Id); err != ErrUploadConflict {
+		t.Error("Commit incomplete upload", err)
+	}
+	if session, err = fs.StatUpload(session.Id); err != nil || session.Offset != 5 {
+		t.Error("Stat upload error", err)
+	}
+	if _, err := fs.WriteUpload(session.Id, session.Offset, bytes.NewReader(fsTestBuffer[5:])); err != nil {
+		t.Error("Write chunk error", err)
+	}
+	if _, err := fs.CommitUpload(session.Id); err != nil {
+		t.Fatal("Commit upload error", err)
+	}
+	_, _, data, err := fs.ReadFile("/upload/a")
+	if err != nil {
+		t.Error("Read file error", err)
+	} else if string(data) != string(fsTestBuffer) {
+		t.Error("Read upload mismatch: " + string(data))
+	} else {
+		t.Log("Upload chunks success: " + string(data))
+	}
+	if _, err := fs.StatUpload(session.Id); err != ErrNotExist {
+		t.Error("Upload session exists after commit", err)
+	}
+
+	// The expires time is computed when committing
+	session, err = fs.CreateUpload("/upload/b", "text/plain", "", -1, &WriteOptions{Expires: time.Now().Unix() + 3600})
+	if err != nil {
+		t.Fatal("Create upload error", err)
+	}
+	if session, err = fs.CommitUpload(session.Id); err != nil {
+		t.Error("Commit upload error", err)
+	} else if session.TTL != 3600 || session.Expires < session.Created+3600 {
+		t.Error("Commit upload expires mismatch", session.TTL, session.Expires)
+	}
+
+	// The session of parts is committed by parts only
+	session, err = fs.CreateUploadParts("/upload/c", "text/plain", "", nil)
+	if err != nil {
+		t.Fatal("Create upload parts error", err)
+	}
+	if _, err := fs.WriteUpload(session.Id, 0, bytes.NewReader(fsTestBuffer)); err != ErrUploadConflict {
+		t.Error("Write chunk of parts", err)
+	}
+	if _, err := fs.CommitUpload(session.Id); err != ErrUploadConflict {
+		t.Error("Commit upload of parts", err)
+	}
+	if _, err := fs.Stat("/upload/c"); err != ErrNotExist {
+		t.Error("Upload parts committed", err)
+	}
+}
+
+func TestFileSystemExpire(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-expire")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	now := time.Now().Unix()
+	if err := fs.WriteFile("/expire/a", "text/plain", "", fsTestBuffer, &WriteOptions{Expires: now - 1}); err != nil {
+		t.Fatal("Write file error", err)
+	}
+	if err := fs.WriteFile("/expire/b", "text/plain", "", fsTestBuffer, &WriteOptions{Expires: now + 3600}); err != nil {
+		t.Fatal("Write file error", err)
+	}
+	if _, err := fs.Stat("/expire/a"); err != ErrNotExist {
+		t.Error("Read expired file", err)
+	}
+	if list, err := fs.List("/expire/", "", "", 0); err != nil || len(list.Files) != 1 {
+		t.Error("List expired file", err)
+	}
+	if err := fs.Rename("/expire/b", "/expire/c", false); err != nil {
+		t.Error("Rename error", err)
+	}
+	if n := fs.CleanExpires(); n != 1 {
+		t.Errorf("Clean expires mismatch: %d", n)
+	}
+	if err := fs.WriteFile("/expire/a", "text/plain", "", fsTestBuffer, &WriteOptions{}); err != nil {
+		t.Error("Write expired path error", err)
+	}
+	hash := sha256.Sum256(fsTestBuffer)
+	hstat, err := fs.StatHash(hex.EncodeToString(hash[:]))
+	if err != nil {
+		t.Error("Stat hash error", err)
+	} else if hstat.Refs != 2 {
+		t.Errorf("Refs mismatch: %d", hstat.Refs)
+	} else {
+		t.Logf("Expire success, refs: %d", hstat.Refs)
+	}
+}
+
+func TestFileSystemTrash(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-trash"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		TrashRetention:   3600,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	for _, v := range []string{"/trash/a", "/trash/b"} {
+		if err := fs.WriteFile(v, "text/plain", "", fsTestBuffer, nil); err != nil {
+			t.Fatal("Write file error", err)
+		}
+		if err := fs.DeleteFile(v); err != nil {
+			t.Fatal("Delete file error", err)
+		}
+	}
+	if list, err := fs.ListTrash("/trash/", "", 0); err != nil || len(list.Files) != 2 {
+		t.Error("List trash error", err)
+	}
+	if _, err := fs.Undelete("/trash/a", false); err != nil {
+		t.Error("Undelete error", err)
+	}
+	if _, _, data, err := fs.ReadFile("/trash/a"); err != nil || string(data) != string(fsTestBuffer) {
+		t.Error("Read undeleted file error", err)
+	}
+	if _, err := fs.Undelete("/trash/a", false); err != ErrNotExist {
+		t.Error("Undelete twice", err)
+	}
+	if n := fs.PurgeTrash(); n != 0 {
+		t.Errorf("Purge in retention: %d", n)
+	}
+	fs.config.TrashRetention = 0
+	if n := fs.PurgeTrash(); n != 1 {
+		t.Errorf("Purge mismatch: %d", n)
+	}
+	hash := sha256.Sum256(fsTestBuffer)
+	hstat, err := fs.StatHash(hex.EncodeToString(hash[:]))
+	if err != nil {
+		t.Error("Stat hash error", err)
+	} else if hstat.Refs != 1 {
+		t.Errorf("Refs mismatch: %d", hstat.Refs)
+	} else {
+		t.Logf("Trash success, refs: %d", hstat.Refs)
+	}
+}
+
+func TestFileSystemVersion(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-version"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VersionMax:       2,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	for _, v := range []string{"v1", "v2", "v3", "v4"} {
+		if err := fs.WriteFile("/version/a", "text/plain", "", []byte(v), nil); err != nil {
+			t.Fatal("Write file error", err)
+		}
+	}
+	versions, err := fs.ListVersions("/version/a")
+	if err != nil || len(versions) != 3 || !versions[0].Current {
+		t.Fatal("List versions error", err)
+	}
+	file, err := fs.OpenFileVersion("/version/a", versions[2].Version)
+	if err != nil {
+		t.Fatal("Open version error", err)
+	}
+	data, _ := ioutil.ReadAll(file)
+	file.Close()
+	if string(data) != "v2" {
+		t.Errorf("Version data mismatch: %s", data)
+	}
+	if _, err := fs.RestoreVersion("/version/a", versions[2].Version); err != nil {
+		t.Error("Restore version error", err)
+	}
+	if _, _, data, err := fs.ReadFile("/version/a"); err != nil || string(data) != "v2" {
+		t.Error("Read restored file error", err)
+	}
+	if _, err := fs.StatVersion("/version/a", versions[2].Version); err != ErrNotExist {
+		t.Error("Version not trimmed", err)
+	}
+	hash := sha256.Sum256([]byte("v1"))
+	if hstat, err := fs.StatHash(hex.EncodeToString(hash[:])); err != nil || hstat.Refs != 0 {
+		t.Error("Trimmed version refs error", err)
+	}
+	hash = sha256.Sum256([]byte("v3"))
+	hstat, err := fs.StatHash(hex.EncodeToString(hash[:]))
+	if err != nil {
+		t.Error("Stat hash error", err)
+	} else if hstat.Refs != 1 {
+		t.Errorf("Refs mismatch: %d", hstat.Refs)
+	} else {
+		t.Logf("Version success, refs: %d", hstat.Refs)
+	}
+
+	// The versions are moved with the file
+	versions, _ = fs.ListVersions("/version/a")
+	if err := fs.Rename("/version/a", "/version/b", false); err != nil {
+		t.Fatal("Rename error", err)
+	}
+	if _, err := fs.ListVersions("/version/a"); err != ErrNotExist {
+		t.Error("Versions of source kept", err)
+	}
+	moved, err := fs.ListVersions("/version/b")
+	if err != nil || len(moved) != len(versions) {
+		t.Fatal("List moved versions error", err)
+	}
+	for i, v := range moved {
+		if v.Version != versions[i].Version || v.Hash != versions[i].Hash {
+			t.Error("Moved version mismatch", v.Version)
+		}
+	}
+	if hstat, err := fs.StatHash(hex.EncodeToString(hash[:])); err != nil || hstat.Refs != 1 {
+		t.Error("Moved version refs error", err)
+	} else {
+		t.Log("Move versions success")
+	}
+}
+
+func TestFileSystemScrub(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-scrub"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	for _, v := range []string{"/scrub/a", "/scrub/b"} {
+		if err := fs.WriteFile(v, "text/plain", "", []byte(v), nil); err != nil {
+			t.Fatal("Write file error", err)
+		}
+	}
+	fnode, err := fs.Stat("/scrub/a")
+	if err != nil {
+		t.Fatal("Stat error", err)
+	}
+	file, err := os.OpenFile(fs.volumeStorages[0].volumePath(fnode.VolumeId), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal("Open volume error", err)
+	}
+	file.WriteAt([]byte("x"), fnode.VolumeOffset)
+	file.Close()
+
+	result, err := fs.Scrub(true)
+	if err != nil {
+		t.Fatal("Scrub error", err)
+	} else if result.Hashs != 2 || result.Corrupted != 1 {
+		t.Errorf("Scrub mismatch: %d hashs, %d corrupted", result.Hashs, result.Corrupted)
+	}
+	if _, _, _, err := fs.ReadFile("/scrub/a"); err != ErrVolumeData {
+		t.Error("Read corrupted file", err)
+	}
+	if _, _, _, err := fs.ReadFile("/scrub/b"); err != nil {
+		t.Error("Read file error", err)
+	}
+	if cnodes, err := fs.ListCorrupted(); err != nil || len(cnodes) != 1 {
+		t.Error("List corrupted error", err)
+	} else {
+		t.Logf("Scrub success, corrupted: %s", cnodes[0].Hash)
+	}
+}
+
+func TestFileSystemReplica(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-replica"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeReplicas:   2,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes0/",
+			},
+			VolumeGroup{
+				Id:   1,
+				Path: "{{DATA}}/volumes1/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	if err := fs.WriteFile("/replica/a", "text/plain", "", []byte("replica"), nil); err != nil {
+		t.Fatal("Write file error", err)
+	}
+	fnode, err := fs.Stat("/replica/a")
+	if err != nil {
+		t.Fatal("Stat error", err)
+	}
+	hstat, err := fs.StatHash(fnode.Hash)
+	if err != nil {
+		t.Fatal("Stat hash error", err)
+	} else if len(hstat.Replicas) != 1 || hstat.Replicas[0].GroupId == fnode.GroupId {
+		t.Fatal("Replicas mismatch", hstat.Replicas)
+	}
+	file, err := os.OpenFile(fs.volumeStorages[fnode.GroupId].volumePath(fnode.VolumeId), os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal("Open volume error", err)
+	}
+	file.WriteAt([]byte("x"), fnode.VolumeOffset)
+	file.Close()
+
+	if _, _, data, err := fs.ReadFile("/replica/a"); err != nil || string(data) != "replica" {
+		t.Error("Read replica error", err)
+	}
+	result, err := fs.RepairReplicas()
+	if err != nil {
+		t.Fatal("Repair replicas error", err)
+	} else if result.Promoted != 1 || result.Created != 1 || result.Lost != 0 {
+		t.Errorf("Repair mismatch: %d promoted, %d created, %d lost", result.Promoted, result.Created, result.Lost)
+	}
+	if xfnode, err := fs.Stat("/replica/a"); err != nil || xfnode.GroupId == fnode.GroupId {
+		t.Error("Promote replica error", err)
+	}
+	if hstat, err := fs.StatHash(fnode.Hash); err != nil || len(hstat.Replicas) != 1 {
+		t.Error("Recreate replica error", err)
+	}
+	if _, _, data, err := fs.ReadFile("/replica/a"); err != nil || string(data) != "replica" {
+		t.Error("Read promoted error", err)
+	} else {
+		t.Log("Replica success")
+	}
+}
+
+func TestFileSystemPlacement(t *testing.T) {
+	config := &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumePolicy:     VolumePolicyWeighted,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:     0,
+				Path:   "{{DATA}}/volumes0/",
+				Weight: 2,
+			},
+			VolumeGroup{
+				Id:   1,
+				Path: "{{DATA}}/volumes1/",
+			},
+			VolumeGroup{
+				Id:   2,
+				Path: "{{DATA}}/volumes2/",
+			},
+		},
+	}
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-placement"), config)
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	counts := map[int]int{}
+	for i := 0; i < 8; i++ {
+		groupId, _ := fs.selectVolumeStorage("/placement/a")
+		counts[groupId]++
+	}
+	if counts[0] != 4 || counts[1] != 2 || counts[2] != 2 {
+		t.Error("Weighted mismatch", counts)
+	}
+
+	config.VolumePolicy = VolumePolicyRoundRobin
+	counts = map[int]int{}
+	for i := 0; i < 6; i++ {
+		groupId, _ := fs.selectVolumeStorage("/placement/a")
+		counts[groupId]++
+	}
+	if counts[0] != 2 || counts[1] != 2 || counts[2] != 2 {
+		t.Error("Round-robin mismatch", counts)
+	}
+
+	config.VolumePolicy = VolumePolicyHash
+	for _, v := range []string{"/placement/a", "/placement/b", "/other/a"} {
+		if err := fs.WriteFile(v, "text/plain", "", []byte(v), nil); err != nil {
+			t.Fatal("Write file error", err)
+		}
+	}
+	a, _ := fs.Stat("/placement/a")
+	b, _ := fs.Stat("/placement/b")
+	if a == nil || b == nil || a.GroupId != b.GroupId {
+		t.Fatal("Hash placement mismatch")
+	}
+	if groupId, _ := fs.selectReplicaStorage("/placement/c", map[int]bool{a.GroupId: true}); groupId == a.GroupId || groupId < 0 {
+		t.Error("Hash placement of used group", groupId)
+	} else {
+		t.Log("Placement success")
+	}
+}
+
+func TestFileSystemDrain(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-drain")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes0/",
+			},
+			VolumeGroup{
+				Id:   1,
+				Path: "{{DATA}}/volumes1/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	for _, v := range []string{"/drain/a", "/drain/b"} {
+		if err := fs.WriteFile(v, "text/plain", "", []byte(v), nil); err != nil {
+			t.Fatal("Write file error", err)
+		}
+	}
+	if err := fs.DeleteFile("/drain/b"); err != nil {
+		t.Fatal("Delete file error", err)
+	}
+	if err := fs.StartDrain(0); err != nil {
+		t.Fatal("Start drain error", err)
+	}
+	var status *DrainStatus
+	for i := 0; i < 100; i++ {
+		if status, err = fs.DrainStatus(0); err != nil {
+			t.Fatal("Drain status error", err)
+		} else if !status.Running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !status.Removable || status.Last == nil || status.Last.Moved != 1 || status.Last.Removed != 1 {
+		t.Errorf("Drain mismatch: %+v %+v", status, status.Last)
+	}
+	if fnode, err := fs.Stat("/drain/a"); err != nil || fnode.GroupId != 1 {
+		t.Error("Drain file error", err)
+	}
+	if _, _, data, err := fs.ReadFile("/drain/a"); err != nil || string(data) != "/drain/a" {
+		t.Error("Read drained file error", err)
+	}
+	if err := fs.WriteFile("/drain/c", "text/plain", "", []byte("/drain/c"), nil); err != nil {
+		t.Fatal("Write file error", err)
+	}
+	if fnode, err := fs.Stat("/drain/c"); err != nil || fnode.GroupId != 1 {
+		t.Error("Write draining group", err)
+	} else {
+		t.Log("Drain success")
+	}
+}
+
+func TestFileSystemReadOnly(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-readonly"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	if err := fs.WriteFile("/readonly/a", "text/plain", "", []byte("a"), nil); err != nil {
+		t.Fatal("Write file error", err)
+	}
+	fs.SetReadOnly(true)
+	if err := fs.WriteFile("/readonly/b", "text/plain", "", []byte("b"), nil); err != ErrReadOnly {
+		t.Error("Write in read-only", err)
+	}
+	if err := fs.DeleteFile("/readonly/a"); err != ErrReadOnly {
+		t.Error("Delete in read-only", err)
+	}
+	if err := fs.Rename("/readonly/a", "/readonly/c", false); err != ErrReadOnly {
+		t.Error("Rename in read-only", err)
+	}
+	if _, _, data, err := fs.ReadFile("/readonly/a"); err != nil || string(data) != "a" {
+		t.Error("Read in read-only", err)
+	}
+	fs.SetReadOnly(false)
+	if err := fs.DeleteFile("/readonly/a"); err != nil {
+		t.Error("Delete file error", err)
+	} else {
+		t.Log("Read-only success")
+	}
+}
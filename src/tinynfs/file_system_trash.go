@@ -0,0 +1,158 @@
+package tinynfs
+
+import (
+	"encoding/json"
+	bolt "github.com/etcd-io/bbolt"
+	"time"
+)
+
+// The trash node of the file path is replaced by the latest deletion
+func (self *FileSystem) txTrashNode(tx *bolt.Tx, filekey []byte, fnode *FileNode, deleted int64) error {
+	var onode *FileNode
+	if err := self.txReadNode(tx, trashBucket, filekey, &onode); err != nil {
+		return err
+	}
+	if onode != nil {
+		if err := self.txUpdateRefs(tx, onode.hashKey(), -1); err != nil {
+			return err
+		}
+	}
+	tnode := *fnode
+	tnode.Deleted = deleted
+	return self.txWriteNode(tx, trashBucket, filekey, &tnode)
+}
+
+func (self *FileSystem) ListTrash(prefix string, cursor string, limit int) (*ListResult, error) {
+	return self.listNodes(trashBucket, prefix, "", cursor, limit)
+}
+
+// Undelete restores the file from trash, the file path must not exist
+// unless overwrite.
+func (self *FileSystem) Undelete(filepath string, overwrite bool) (*FileNode, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return nil, err
+	}
+
+	self.writeLock.RLock()
+	defer self.writeLock.RUnlock()
+
+	filekey := []byte(filepath)
+	var tnode *FileNode
+	if err := self.readNode(trashBucket, filekey, &tnode); err != nil {
+		return nil, err
+	}
+	if tnode == nil {
+		return nil, ErrNotExist
+	}
+	if !overwrite {
+		if _, err := self.Stat(filepath); err == nil {
+			return nil, ErrExist
+		}
+	}
+	fnode := *tnode
+	fnode.Deleted = 0
+	if err := self.writeRecord(RecordKindLink, filepath, &fnode); err != nil {
+		return nil, err
+	}
+
+	var ofnode *FileNode
+	err := self.storageDB.Update(func(tx *bolt.Tx) error {
+		var xtnode *FileNode
+		if err := self.txReadNode(tx, trashBucket, filekey, &xtnode); err != nil {
+			return err
+		}
+		if xtnode == nil || xtnode.Deleted != tnode.Deleted {
+			return ErrNotExist
+		}
+		if err := self.txReadNode(tx, fileBucket, filekey, &ofnode); err != nil {
+			return err
+		}
+		if ofnode != nil && !ofnode.isExpired() && !overwrite {
+			return ErrExist
+		}
+		// The location maybe changed by compaction
+		var hnode *HashNode
+		if err := self.txReadNode(tx, hashBucket, fnode.hashKey(), &hnode); err != nil {
+			return err
+		}
+		if hnode == nil {
+			return ErrNotExist
+		}
+		fnode.HashNode = *hnode
+		if err := self.txWriteNode(tx, fileBucket, filekey, &fnode); err != nil {
+			return err
+		}
+		if err := self.txUpdateExpires(tx, filekey, ofnode, &fnode); err != nil {
+			return err
+		}
+		if err := tx.Bucket(trashBucket).Delete(filekey); err != nil {
+			return err
+		}
+		return self.txReleaseNode(tx, filekey, ofnode)
+	})
+	if err != nil {
+		// Revoke the record written above
+		if ofnode != nil {
+			self.writeRecord(RecordKindLink, filepath, ofnode)
+		} else {
+			self.writeRecord(RecordKindDelete, filepath, tnode)
+		}
+		return nil, err
+	}
+	self.timeOnUpdate = time.Now().Unix()
+	return &fnode, nil
+}
+
+// PurgeTrash removes the trash nodes deleted longer than the retention, all
+// of them are removed when trash disabled.
+func (self *FileSystem) PurgeTrash() int {
+	if self.IsReadOnly() {
+		return 0
+	}
+
+	self.writeLock.RLock()
+	defer self.writeLock.RUnlock()
+
+	count := 0
+	expired := time.Now().Unix() - self.config.TrashRetention
+	err := self.storageDB.Update(func(tx *bolt.Tx) error {
+		bt := tx.Bucket(trashBucket)
+		tnodes := map[string]*FileNode{}
+		err := bt.ForEach(func(k, v []byte) error {
+			var tnode FileNode
+			if err := json.Unmarshal(v, &tnode); err != nil {
+				return err
+			}
+			if tnode.Deleted <= expired {
+				tnodes[string(k)] = &tnode
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for k, tnode := range tnodes {
+			if err := bt.Delete([]byte(k)); err != nil {
+				return err
+			}
+			if err := self.txUpdateRefs(tx, tnode.hashKey(), -1); err != nil {
+				return err
+			}
+			// The versions of the deleted file are purged together
+			if tx.Bucket(fileBucket).Get([]byte(k)) == nil {
+				if err := self.txDeleteVersions(tx, []byte(k)); err != nil {
+					return err
+				}
+			}
+		}
+		count = len(tnodes)
+		return nil
+	})
+	if err != nil {
+		return 0
+	}
+	if count > 0 {
+		self.timeOnUpdate = time.Now().Unix()
+	}
+	return count
+}
@@ -0,0 +1,438 @@
+package tinynfs
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+type UploadSession struct {
+	Id        string `json:"id"`
+	FilePath  string `json:"filepath"`
+	Mime      string `json:"mime"`
+	Metadata  string `json:"metadata"`
+	Size      int64  `json:"size"`
+	Offset    int64  `json:"offset"`
+	Overwrite bool   `json:"overwrite"`
+	Created   int64  `json:"created"`
+	Expires   int64  `json:"expires"`
+	TTL       int64  `json:"ttl,omitempty"`
+	Parts     bool   `json:"parts,omitempty"`
+	Filename  string `json:"filename,omitempty"`
+
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+type UploadPart struct {
+	Number int    `json:"number"`
+	Size   int64  `json:"size"`
+	Hash   string `json:"hash"`
+}
+
+var (
+	uploadIdRegexp = regexp.MustCompile("^[0-9a-f]{32}$")
+)
+
+// The upload sessions are kept after restart, not in the temporary path
+func (self *FileSystem) uploadPath(id string) string {
+	return filepath.Join(self.root, "uploads", id)
+}
+
+func (self *FileSystem) lockUpload(id string) error {
+	self.uploadLock.Lock()
+	defer self.uploadLock.Unlock()
+
+	if self.uploading[id] {
+		return ErrUploadConflict
+	}
+	self.uploading[id] = true
+	return nil
+}
+
+func (self *FileSystem) unlockUpload(id string) {
+	self.uploadLock.Lock()
+	defer self.uploadLock.Unlock()
+
+	delete(self.uploading, id)
+}
+
+func (self *FileSystem) readUpload(id string) (*UploadSession, error) {
+	if !uploadIdRegexp.MatchString(id) {
+		return nil, ErrParam
+	}
+	b, err := ioutil.ReadFile(self.uploadPath(id) + ".json")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	var session UploadSession
+	if err := json.Unmarshal(b, &session); err != nil {
+		return nil, err
+	}
+	stat, err := os.Stat(self.uploadPath(id) + ".data")
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, ErrNotExist
+		}
+		return nil, err
+	}
+	session.Offset = stat.Size()
+	return &session, nil
+}
+
+func (self *FileSystem) removeUpload(id string) {
+	files, _ := filepath.Glob(self.uploadPath(id) + ".*")
+	for _, v := range files {
+		os.Remove(v)
+	}
+}
+
+// CreateUpload starts a session to upload the file by chunks, the size is -1
+// when it is unknown.
+func (self *FileSystem) CreateUpload(filepath string, filemime string, metadata string, size int64, options *WriteOptions) (*UploadSession, error) {
+	return self.createUpload(filepath, filemime, metadata, size, false, options)
+}
+
+// CreateUploadParts starts a session to upload the file by numbered parts
+func (self *FileSystem) CreateUploadParts(filepath string, filemime string, metadata string, options *WriteOptions) (*UploadSession, error) {
+	return self.createUpload(filepath, filemime, metadata, -1, true, options)
+}
+
+func (self *FileSystem) createUpload(filepath string, filemime string, metadata string, size int64, parts bool, options *WriteOptions) (*UploadSession, error) {
+	if options == nil {
+		options = defaultWriteOptions
+	}
+	if err := self.checkWritable(filepath, options); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	session := &UploadSession{
+		Id:        hex.EncodeToString(b),
+		FilePath:  filepath,
+		Mime:      filemime,
+		Metadata:  metadata,
+		Size:      size,
+		Overwrite: options.Overwrite,
+		Created:   time.Now().Unix(),
+		Expires:   options.Expires,
+		Parts:     parts,
+		Filename:  options.Filename,
+		Meta:      options.Meta,
+	}
+	// The time to live is kept, the expires time is computed when committing
+	if session.Expires > 0 {
+		session.TTL = session.Expires - session.Created
+	}
+	data, err := json.Marshal(session)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(self.uploadPath(session.Id)+".data", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	if err := ioutil.WriteFile(self.uploadPath(session.Id)+".json", data, 0644); err != nil {
+		self.removeUpload(session.Id)
+		return nil, err
+	}
+	return session, nil
+}
+
+func (self *UploadSession) setExpires() {
+	if self.TTL > 0 {
+		self.Expires = time.Now().Unix() + self.TTL
+	}
+}
+
+func (self *FileSystem) StatUpload(id string) (*UploadSession, error) {
+	return self.readUpload(id)
+}
+
+// WriteUpload appends the chunk at the offset, the offset must be the size
+// uploaded. The written part of a broken chunk is kept for resuming.
+func (self *FileSystem) WriteUpload(id string, offset int64, reader io.Reader) (*UploadSession, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return nil, err
+	}
+	if err := self.lockUpload(id); err != nil {
+		return nil, err
+	}
+	defer self.unlockUpload(id)
+
+	session, err := self.readUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if session.Parts || offset != session.Offset {
+		return nil, ErrUploadConflict
+	}
+	dstat, err := GetPathDiskStat(self.root)
+	if err != nil {
+		return nil, err
+	} else if dstat.Free < uint64(self.config.DiskRemain) {
+		return nil, ErrIndexStorageFully
+	}
+
+	file, err := os.OpenFile(self.uploadPath(id)+".data", os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if session.Size >= 0 {
+		reader = io.LimitReader(reader, session.Size-offset+1)
+	}
+	n, err := io.Copy(file, reader)
+	if err == ErrPermission {
+		// Drop the chunk failed the content verification
+		if err := file.Truncate(offset); err != nil {
+			return nil, err
+		}
+		return nil, ErrPermission
+	}
+	if err == nil && session.Size >= 0 && offset+n > session.Size {
+		// Drop the chunk larger than the declared size
+		if err := file.Truncate(offset); err != nil {
+			return nil, err
+		}
+		return nil, ErrParam
+	}
+	session.Offset += n
+	if err != nil {
+		return session, err
+	}
+	return session, nil
+}
+
+// WriteUploadPart saves the part, the parts can be written in any order and
+// concurrently. The same part number is replaced.
+func (self *FileSystem) WriteUploadPart(id string, number int, reader io.Reader) (*UploadPart, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return nil, err
+	}
+	if number < 1 {
+		return nil, ErrParam
+	}
+	if session, err := self.readUpload(id); err != nil {
+		return nil, err
+	} else if !session.Parts {
+		return nil, ErrUploadConflict
+	}
+	dstat, err := GetPathDiskStat(self.root)
+	if err != nil {
+		return nil, err
+	} else if dstat.Free < uint64(self.config.DiskRemain) {
+		return nil, ErrIndexStorageFully
+	}
+
+	file, err := ioutil.TempFile(filepath.Join(self.root, "uploads"), id+".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(file.Name())
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), reader)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Rename(file.Name(), fmt.Sprintf("%s.%d.part", self.uploadPath(id), number)); err != nil {
+		return nil, err
+	}
+	return &UploadPart{number, size, hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+func (self *FileSystem) openUploadParts(id string, parts []*UploadPart) ([]*os.File, int64, []byte, error) {
+	files := []*os.File{}
+	closeFiles := func() {
+		for _, v := range files {
+			v.Close()
+		}
+	}
+	size := int64(0)
+	hash := sha256.New()
+	for i, part := range parts {
+		if i > 0 && part.Number <= parts[i-1].Number {
+			closeFiles()
+			return nil, 0, nil, ErrParam
+		}
+		file, err := os.Open(fmt.Sprintf("%s.%d.part", self.uploadPath(id), part.Number))
+		if err != nil {
+			closeFiles()
+			if os.IsNotExist(err) {
+				return nil, 0, nil, ErrParam
+			}
+			return nil, 0, nil, err
+		}
+		files = append(files, file)
+		phash := sha256.New()
+		n, err := io.Copy(io.MultiWriter(hash, phash), file)
+		if err == nil {
+			_, err = file.Seek(0, io.SeekStart)
+		}
+		if err != nil {
+			closeFiles()
+			return nil, 0, nil, err
+		}
+		if len(part.Hash) > 0 && part.Hash != hex.EncodeToString(phash.Sum(nil)) {
+			closeFiles()
+			return nil, 0, nil, ErrParam
+		}
+		size += n
+	}
+	return files, size, hash.Sum(nil), nil
+}
+
+// CommitUploadParts joins the parts by the number order as the file, the hash
+// of part is verified when it is not empty.
+func (self *FileSystem) CommitUploadParts(id string, parts []*UploadPart) (*UploadSession, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return nil, err
+	}
+	if len(parts) < 1 {
+		return nil, ErrParam
+	}
+	if err := self.lockUpload(id); err != nil {
+		return nil, err
+	}
+	defer self.unlockUpload(id)
+
+	session, err := self.readUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if !session.Parts {
+		return nil, ErrUploadConflict
+	}
+	session.setExpires()
+	files, size, hashkey, err := self.openUploadParts(id, parts)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, v := range files {
+			v.Close()
+		}
+	}()
+	readers := make([]io.Reader, len(files))
+	for i, v := range files {
+		readers[i] = v
+	}
+	options := &WriteOptions{
+		Overwrite: session.Overwrite,
+		Expires:   session.Expires,
+		Filename:  session.Filename,
+		Meta:      session.Meta,
+	}
+	if err := self.writeFile(session.FilePath, session.Mime, session.Metadata, hashkey, size, io.MultiReader(readers...), options); err != nil {
+		return nil, err
+	}
+	self.removeUpload(id)
+	session.Offset = size
+	return session, nil
+}
+
+// CommitUpload writes the uploaded data to the volume storage and the index,
+// then removes the session.
+func (self *FileSystem) CommitUpload(id string) (*UploadSession, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return nil, err
+	}
+	if err := self.lockUpload(id); err != nil {
+		return nil, err
+	}
+	defer self.unlockUpload(id)
+
+	session, err := self.readUpload(id)
+	if err != nil {
+		return nil, err
+	}
+	if session.Parts || (session.Size >= 0 && session.Offset != session.Size) {
+		return nil, ErrUploadConflict
+	}
+	session.setExpires()
+	file, err := os.Open(self.uploadPath(id) + ".data")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return nil, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	options := &WriteOptions{
+		Overwrite: session.Overwrite,
+		Expires:   session.Expires,
+		Filename:  session.Filename,
+		Meta:      session.Meta,
+	}
+	if err := self.writeFile(session.FilePath, session.Mime, session.Metadata, hash.Sum(nil), session.Offset, file, options); err != nil {
+		return nil, err
+	}
+	self.removeUpload(id)
+	return session, nil
+}
+
+func (self *FileSystem) AbortUpload(id string) error {
+	if err := self.lockUpload(id); err != nil {
+		return err
+	}
+	defer self.unlockUpload(id)
+
+	if _, err := self.readUpload(id); err != nil {
+		return err
+	}
+	self.removeUpload(id)
+	return nil
+}
+
+// CleanUploads removes the sessions inactive longer than the expire time
+func (self *FileSystem) CleanUploads() int {
+	if self.config.UploadExpire < 1 {
+		return 0
+	}
+	files, err := ioutil.ReadDir(filepath.Join(self.root, "uploads"))
+	if err != nil {
+		return 0
+	}
+	// The latest modified time of the session files
+	actives := map[string]int64{}
+	for _, file := range files {
+		id := strings.Split(file.Name(), ".")[0]
+		if mtime := file.ModTime().Unix(); mtime > actives[id] {
+			actives[id] = mtime
+		}
+	}
+	count := 0
+	expired := time.Now().Unix() - self.config.UploadExpire
+	for id, mtime := range actives {
+		if mtime > expired {
+			continue
+		}
+		if !uploadIdRegexp.MatchString(id) || self.lockUpload(id) != nil {
+			continue
+		}
+		self.removeUpload(id)
+		self.unlockUpload(id)
+		count++
+	}
+	return count
+}
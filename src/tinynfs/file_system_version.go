@@ -0,0 +1,282 @@
+package tinynfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	bolt "github.com/etcd-io/bbolt"
+	"time"
+)
+
+type VersionEntry struct {
+	Version int64  `json:"version"`
+	Size    int    `json:"size"`
+	Mime    string `json:"mime"`
+	Hash    string `json:"hash"`
+	Created int64  `json:"created"`
+	Current bool   `json:"current"`
+}
+
+// The key of versions bucket is the file path, a zero byte, then the version
+// id, so the versions of a file path are sorted from the oldest.
+func encodeVersionKey(filekey []byte, version int64) []byte {
+	key := make([]byte, len(filekey)+1+8)
+	copy(key, filekey)
+	binary.BigEndian.PutUint64(key[len(filekey)+1:], uint64(version))
+	return key
+}
+
+func versionPrefix(filekey []byte) []byte {
+	return append(append([]byte{}, filekey...), 0)
+}
+
+// The node written by old version has no version id
+func (self *FileNode) versionId() int64 {
+	if self.Version > 0 {
+		return self.Version
+	}
+	return self.Created * int64(time.Second)
+}
+
+func (self *FileNode) toVersionEntry(current bool) *VersionEntry {
+	return &VersionEntry{
+		Version: self.versionId(),
+		Size:    self.Size,
+		Mime:    self.Mime,
+		Hash:    self.Hash,
+		Created: self.Created,
+		Current: current,
+	}
+}
+
+// txReleaseNode is called after the node of file path was replaced, the old
+// node is kept as a version when versioning enabled, otherwise its reference
+// is released.
+func (self *FileSystem) txReleaseNode(tx *bolt.Tx, filekey []byte, ofnode *FileNode) error {
+	if ofnode == nil {
+		return nil
+	}
+	if self.config.VersionMax < 1 || ofnode.isExpired() {
+		return self.txUpdateRefs(tx, ofnode.hashKey(), -1)
+	}
+
+	key := encodeVersionKey(filekey, ofnode.versionId())
+	var vnode *FileNode
+	if err := self.txReadNode(tx, versionBucket, key, &vnode); err != nil {
+		return err
+	}
+	if vnode != nil {
+		if err := self.txUpdateRefs(tx, vnode.hashKey(), -1); err != nil {
+			return err
+		}
+	}
+	xnode := *ofnode
+	xnode.Expires = 0
+	if err := self.txWriteNode(tx, versionBucket, key, &xnode); err != nil {
+		return err
+	}
+	return self.txTrimVersions(tx, filekey, self.config.VersionMax)
+}
+
+// Remove the oldest versions of file path, keep the max versions
+func (self *FileSystem) txTrimVersions(tx *bolt.Tx, filekey []byte, max int) error {
+	bt := tx.Bucket(versionBucket)
+	prefix := versionPrefix(filekey)
+	keys := [][]byte{}
+	vnodes := []*FileNode{}
+	c := bt.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		var vnode FileNode
+		if err := json.Unmarshal(v, &vnode); err != nil {
+			return err
+		}
+		keys = append(keys, append([]byte{}, k...))
+		vnodes = append(vnodes, &vnode)
+	}
+	for i := 0; i < len(keys)-max; i++ {
+		if err := bt.Delete(keys[i]); err != nil {
+			return err
+		}
+		if err := self.txUpdateRefs(tx, vnodes[i].hashKey(), -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self *FileSystem) txDeleteVersions(tx *bolt.Tx, filekey []byte) error {
+	return self.txTrimVersions(tx, filekey, 0)
+}
+
+// txMoveVersions moves the versions of src file path to dst, the versions of
+// the same id in dst are replaced.
+func (self *FileSystem) txMoveVersions(tx *bolt.Tx, src []byte, dst []byte) error {
+	bt := tx.Bucket(versionBucket)
+	prefix := versionPrefix(src)
+	keys := [][]byte{}
+	values := [][]byte{}
+	c := bt.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		keys = append(keys, append([]byte{}, k...))
+		values = append(values, append([]byte{}, v...))
+	}
+	if len(keys) < 1 {
+		return nil
+	}
+	for i, k := range keys {
+		if err := bt.Delete(k); err != nil {
+			return err
+		}
+		key := append(versionPrefix(dst), k[len(prefix):]...)
+		var vnode *FileNode
+		if err := self.txReadNode(tx, versionBucket, key, &vnode); err != nil {
+			return err
+		}
+		if vnode != nil {
+			if err := self.txUpdateRefs(tx, vnode.hashKey(), -1); err != nil {
+				return err
+			}
+		}
+		if err := bt.Put(key, values[i]); err != nil {
+			return err
+		}
+	}
+	if self.config.VersionMax < 1 {
+		return nil
+	}
+	return self.txTrimVersions(tx, dst, self.config.VersionMax)
+}
+
+// StatVersion returns the node of the version, the current file node is
+// matched too.
+func (self *FileSystem) StatVersion(filepath string, version int64) (*FileNode, error) {
+	filekey := []byte(filepath)
+	var vnode *FileNode
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		var fnode *FileNode
+		if err := self.txReadNode(tx, fileBucket, filekey, &fnode); err != nil {
+			return err
+		}
+		if fnode != nil && !fnode.isExpired() && fnode.versionId() == version {
+			vnode = fnode
+			return nil
+		}
+		return self.txReadNode(tx, versionBucket, encodeVersionKey(filekey, version), &vnode)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if vnode == nil {
+		return nil, ErrNotExist
+	}
+	return vnode, nil
+}
+
+func (self *FileSystem) OpenFileVersion(filepath string, version int64) (*FileReader, error) {
+	return self.openNode(func() (*FileNode, error) {
+		return self.StatVersion(filepath, version)
+	})
+}
+
+// ListVersions returns the current file and the kept versions, from the
+// newest.
+func (self *FileSystem) ListVersions(filepath string) ([]*VersionEntry, error) {
+	filekey := []byte(filepath)
+	entries := []*VersionEntry{}
+	err := self.storageDB.View(func(tx *bolt.Tx) error {
+		prefix := versionPrefix(filekey)
+		c := tx.Bucket(versionBucket).Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			var vnode FileNode
+			if err := json.Unmarshal(v, &vnode); err != nil {
+				return err
+			}
+			entries = append([]*VersionEntry{vnode.toVersionEntry(false)}, entries...)
+		}
+		var fnode *FileNode
+		if err := self.txReadNode(tx, fileBucket, filekey, &fnode); err != nil {
+			return err
+		}
+		if fnode != nil && !fnode.isExpired() {
+			entries = append([]*VersionEntry{fnode.toVersionEntry(true)}, entries...)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) < 1 {
+		return nil, ErrNotExist
+	}
+	return entries, nil
+}
+
+// RestoreVersion writes the version as the new current file, the replaced
+// file is kept as a version too.
+func (self *FileSystem) RestoreVersion(filepath string, version int64) (*FileNode, error) {
+	if err := self.checkReadOnly(); err != nil {
+		return nil, err
+	}
+
+	self.writeLock.RLock()
+	defer self.writeLock.RUnlock()
+
+	filekey := []byte(filepath)
+	var vnode *FileNode
+	if err := self.readNode(versionBucket, encodeVersionKey(filekey, version), &vnode); err != nil {
+		return nil, err
+	}
+	if vnode == nil {
+		return nil, ErrNotExist
+	}
+	fnode := *vnode
+	fnode.Created = time.Now().Unix()
+	fnode.Version = time.Now().UnixNano()
+	if err := self.writeRecord(RecordKindLink, filepath, &fnode); err != nil {
+		return nil, err
+	}
+
+	var ofnode *FileNode
+	err := self.storageDB.Update(func(tx *bolt.Tx) error {
+		var xvnode *FileNode
+		if err := self.txReadNode(tx, versionBucket, encodeVersionKey(filekey, version), &xvnode); err != nil {
+			return err
+		}
+		if xvnode == nil {
+			return ErrNotExist
+		}
+		// The location maybe changed by compaction
+		var hnode *HashNode
+		if err := self.txReadNode(tx, hashBucket, fnode.hashKey(), &hnode); err != nil {
+			return err
+		}
+		if hnode == nil {
+			return ErrNotExist
+		}
+		fnode.HashNode = *hnode
+		if err := self.txReadNode(tx, fileBucket, filekey, &ofnode); err != nil {
+			return err
+		}
+		if err := self.txWriteNode(tx, fileBucket, filekey, &fnode); err != nil {
+			return err
+		}
+		if err := self.txUpdateExpires(tx, filekey, ofnode, &fnode); err != nil {
+			return err
+		}
+		if err := self.txUpdateRefs(tx, fnode.hashKey(), 1); err != nil {
+			return err
+		}
+		return self.txReleaseNode(tx, filekey, ofnode)
+	})
+	if err != nil {
+		// Revoke the record written above
+		if ofnode != nil {
+			self.writeRecord(RecordKindLink, filepath, ofnode)
+		} else {
+			self.writeRecord(RecordKindDelete, filepath, nil)
+		}
+		return nil, err
+	}
+	self.timeOnUpdate = time.Now().Unix()
+	return &fnode, nil
+}
@@ -1,18 +1,51 @@
 package tinynfs
 
 import (
+	"bytes"
 	"encoding/json"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	metaHeaderPrefix = "X-Meta-"
+	metaFormPrefix   = "meta-"
+	metaMaxSize      = 8 * 1024
+)
+
+var (
+	metaKeyRegexp = regexp.MustCompile("^[0-9a-z][0-9a-z_-]*$")
 )
 
 type HttpServer struct {
-	closed        bool
-	config        *Network
-	storage       *FileSystem
-	fileListener  net.Listener
-	imageListener net.Listener
+	closed         bool
+	started        int64
+	config         *Network
+	storage        *FileSystem
+	fileListener   net.Listener
+	imageListener  net.Listener
+	s3Listener     net.Listener
+	webdavListener net.Listener
+}
+
+// The body of HEAD request never be read
+type headReader struct{}
+
+func (headReader) ReadAt(p []byte, off int64) (int, error) {
+	return 0, io.EOF
+}
+
+func newHeadFileReader(fnode *FileNode) *FileReader {
+	return &FileReader{
+		VolumeReader: &VolumeReader{SectionReader: io.NewSectionReader(headReader{}, 0, int64(fnode.Size))},
+		Node:         fnode,
+	}
 }
 
 func (self *HttpServer) Close() {
@@ -23,9 +56,17 @@ func (self *HttpServer) Close() {
 	if self.imageListener != nil {
 		self.imageListener.Close()
 	}
+	if self.s3Listener != nil {
+		self.s3Listener.Close()
+	}
+	if self.webdavListener != nil {
+		self.webdavListener.Close()
+	}
 }
 
-func (self *HttpServer) sendByteData(res http.ResponseWriter, req *http.Request, err *error, mime *string, data *[]byte) {
+// The node is the stored file of data, its hash and created time are the ETag
+// and the modified time.
+func (self *HttpServer) sendByteData(res http.ResponseWriter, req *http.Request, err *error, mime *string, node **FileNode, data *[]byte) {
 	if *err != nil {
 		statusCode := toStatusCode(*err)
 		http.Error(res, (*err).Error(), statusCode)
@@ -36,8 +77,38 @@ func (self *HttpServer) sendByteData(res http.ResponseWriter, req *http.Request,
 		} else {
 			header.Set("Content-Type", "application/octet-stream")
 		}
-		header.Set("Content-Length", strconv.Itoa(len(*data)))
-		res.Write(*data)
+		if len((*node).Hash) > 0 {
+			header.Set("ETag", "\""+(*node).Hash+"\"")
+		}
+		http.ServeContent(res, req, "", time.Unix((*node).Created, 0), bytes.NewReader(*data))
+	}
+}
+
+func (self *HttpServer) sendFileData(res http.ResponseWriter, req *http.Request, err *error, file **FileReader) {
+	if *err != nil {
+		statusCode := toStatusCode(*err)
+		http.Error(res, (*err).Error(), statusCode)
+	} else {
+		defer (*file).Close()
+		node := (*file).Node
+		header := res.Header()
+		if len(node.Mime) > 0 {
+			header.Set("Content-Type", node.Mime)
+		} else {
+			header.Set("Content-Type", "application/octet-stream")
+		}
+		if len(node.Hash) > 0 {
+			header.Set("ETag", "\""+node.Hash+"\"")
+		}
+		for k, v := range node.Meta {
+			header.Set(metaHeaderPrefix+k, v)
+		}
+		// Support the range and conditional requests
+		http.ServeContent(res, req, "", time.Unix(node.Created, 0), *file)
+		if (*file).corrupted {
+			// Break the response, the client must not accept the data
+			panic(http.ErrAbortHandler)
+		}
 	}
 }
 
@@ -59,9 +130,119 @@ func (self *HttpServer) parseRequestBody(req *http.Request) error {
 	if err := req.ParseMultipartForm(32 * 1024 * 1024); err != nil {
 		return err
 	}
+	// The rest of body is read for the content hash verification
+	if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+		return err
+	}
+	return nil
+}
+
+// The time to live in seconds as the expires time, 0 when it is empty
+func parseTTL(value string) (int64, error) {
+	if len(value) < 1 {
+		return 0, nil
+	}
+	ttl, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || ttl < 1 {
+		return 0, ErrParam
+	}
+	return time.Now().Unix() + ttl, nil
+}
+
+func parseVersion(value string) (int64, error) {
+	if len(value) < 1 {
+		return 0, nil
+	}
+	version, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || version < 1 {
+		return 0, ErrParam
+	}
+	return version, nil
+}
+
+// The user metadata key is case insensitive, saved in lower case
+func addMeta(meta map[string]string, key string, value string) error {
+	key = strings.ToLower(key)
+	if !metaKeyRegexp.MatchString(key) || strings.ContainsAny(value, "\r\n") {
+		return ErrParam
+	}
+	meta[key] = value
+	size := 0
+	for k, v := range meta {
+		size += len(k) + len(v)
+	}
+	if size > metaMaxSize {
+		return ErrParam
+	}
 	return nil
 }
 
+// The user metadata of request is sent by the X-Meta-* headers, or the
+// meta-* form fields
+func parseMeta(req *http.Request) (map[string]string, error) {
+	meta := map[string]string{}
+	for k, v := range req.Header {
+		if strings.HasPrefix(k, metaHeaderPrefix) && len(v) > 0 {
+			if err := addMeta(meta, k[len(metaHeaderPrefix):], v[0]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for k, v := range req.Form {
+		if strings.HasPrefix(k, metaFormPrefix) && len(v) > 0 {
+			if err := addMeta(meta, k[len(metaFormPrefix):], v[0]); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(meta) < 1 {
+		return nil, nil
+	}
+	return meta, nil
+}
+
+// The filename is encoded by RFC 5987 when it is not ASCII, with the ASCII
+// fallback for the old clients.
+func contentDisposition(dtype string, filename string) string {
+	if len(filename) < 1 {
+		return dtype
+	}
+	ascii := true
+	fallback := make([]byte, 0, len(filename))
+	for i := 0; i < len(filename); i++ {
+		c := filename[i]
+		if c < 0x20 || c >= 0x7F {
+			ascii = false
+			c = '_'
+		} else if c == '"' || c == '\\' {
+			c = '_'
+		}
+		fallback = append(fallback, c)
+	}
+	value := dtype + "; filename=\"" + string(fallback) + "\""
+	if ascii {
+		return value
+	}
+	const hex = "0123456789ABCDEF"
+	encoded := make([]byte, 0, len(filename)*3)
+	for i := 0; i < len(filename); i++ {
+		c := filename[i]
+		if ('0' <= c && c <= '9') || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			encoded = append(encoded, c)
+		} else {
+			encoded = append(encoded, '%', hex[c>>4], hex[c&15])
+		}
+	}
+	return value + "; filename*=UTF-8''" + string(encoded)
+}
+
+func (self *HttpServer) statVersion(filepath string, version int64) (*FileNode, error) {
+	if version > 0 {
+		return self.storage.StatVersion(filepath, version)
+	}
+	return self.storage.Stat(filepath)
+}
+
 func NewHttpServer(storage *FileSystem, config *Network) (*HttpServer, error) {
 	fileListener, err := net.Listen(config.Tcp, config.FileBind)
 	if err != nil {
@@ -73,14 +254,46 @@ func NewHttpServer(storage *FileSystem, config *Network) (*HttpServer, error) {
 		return nil, err
 	}
 
+	var s3Listener net.Listener
+	if len(config.S3Bind) > 0 {
+		s3Listener, err = net.Listen(config.Tcp, config.S3Bind)
+		if err != nil {
+			fileListener.Close()
+			imageListener.Close()
+			return nil, err
+		}
+	}
+
+	var webdavListener net.Listener
+	if len(config.WebDAVBind) > 0 {
+		webdavListener, err = net.Listen(config.Tcp, config.WebDAVBind)
+		if err != nil {
+			fileListener.Close()
+			imageListener.Close()
+			if s3Listener != nil {
+				s3Listener.Close()
+			}
+			return nil, err
+		}
+	}
+
 	srv := &HttpServer{
-		config:        config,
-		storage:       storage,
-		fileListener:  fileListener,
-		imageListener: imageListener,
+		started:        time.Now().Unix(),
+		config:         config,
+		storage:        storage,
+		fileListener:   fileListener,
+		imageListener:  imageListener,
+		s3Listener:     s3Listener,
+		webdavListener: webdavListener,
 	}
 
 	go srv.startFile()
 	go srv.startImage()
+	if s3Listener != nil {
+		go srv.startS3()
+	}
+	if webdavListener != nil {
+		go srv.startWebDAV()
+	}
 	return srv, nil
 }
@@ -0,0 +1,241 @@
+package tinynfs
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuthRead   = "read"
+	AuthWrite  = "write"
+	AuthDelete = "delete"
+	AuthAdmin  = "admin"
+
+	authHmacScheme     = "HMAC-SHA256"
+	authContentHeader  = "X-Content-Sha256"
+	authMaxClockSkew   = 15 * time.Minute
+	authMaxPresignTime = 7 * 24 * 3600
+)
+
+func authSignature(secret string, method string, uri string, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(method + "\n" + uri + "\n" + timestamp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// The signature of request covers the hex sha256 of its body
+func requestSignature(secret string, method string, uri string, timestamp string, contentHash string) string {
+	return authSignature(secret, method, uri, timestamp+"\n"+contentHash)
+}
+
+func presignSignature(secret string, method string, operation string, filepath string, expires string) string {
+	return authSignature(secret, method, operation+"\n"+filepath, expires)
+}
+
+// SignURL makes the query string of the presigned url by the key, it allows
+// the method and operation on the file path before the expires time.
+func SignURL(akey *AuthKey, method string, operation string, filepath string, expires int64) string {
+	sexpires := strconv.FormatInt(expires, 10)
+	query := url.Values{}
+	query.Set("key", akey.Key)
+	query.Set("expires", sexpires)
+	query.Set("signature", presignSignature(akey.Secret, method, operation, filepath, sexpires))
+	return query.Encode()
+}
+
+func (self *HttpServer) verifyPresigned(query url.Values, method string, operation string, filepath string) error {
+	akey, ok := self.config.AuthKeys[query.Get("key")]
+	if !ok {
+		return ErrPermission
+	}
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return ErrPermission
+	}
+	// The HEAD request is allowed by the GET url
+	expected := presignSignature(akey.Secret, method, operation, filepath, query.Get("expires"))
+	if method == "HEAD" && !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) {
+		expected = presignSignature(akey.Secret, "GET", operation, filepath, query.Get("expires"))
+	}
+	if !hmac.Equal([]byte(expected), []byte(query.Get("signature"))) || !akey.allow(operation, filepath) {
+		return ErrPermission
+	}
+	return nil
+}
+
+func (self *HttpServer) isPrivate(filepath string) bool {
+	for _, prefix := range self.config.AuthPrivates {
+		if strings.HasPrefix(filepath, prefix) || filepath+"/" == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate finds the key of request by the Basic authorization or the
+// HMAC signature, the key is nil when the credentials were not sent.
+func (self *HttpServer) authenticate(req *http.Request) (*AuthKey, error) {
+	if key, secret, ok := req.BasicAuth(); ok {
+		akey, ok := self.config.AuthKeys[key]
+		if !ok || !hmac.Equal([]byte(akey.Secret), []byte(secret)) {
+			return nil, ErrPermission
+		}
+		return akey, nil
+	}
+
+	auth := req.Header.Get("Authorization")
+	if len(auth) < 1 {
+		return nil, nil
+	}
+	if !strings.HasPrefix(auth, authHmacScheme+" ") {
+		return nil, ErrPermission
+	}
+	// HMAC-SHA256 <key>:<timestamp>:<signature>
+	fields := strings.Split(auth[len(authHmacScheme)+1:], ":")
+	if len(fields) != 3 {
+		return nil, ErrPermission
+	}
+	akey, ok := self.config.AuthKeys[fields[0]]
+	if !ok {
+		return nil, ErrPermission
+	}
+	timestamp, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return nil, ErrPermission
+	}
+	if skew := time.Since(time.Unix(timestamp, 0)); skew > authMaxClockSkew || skew < -authMaxClockSkew {
+		return nil, ErrPermission
+	}
+	contentHash := req.Header.Get(authContentHeader)
+	if len(contentHash) != sha256.Size*2 {
+		return nil, ErrPermission
+	}
+	expected := requestSignature(akey.Secret, req.Method, req.RequestURI, fields[1], strings.ToLower(contentHash))
+	if !hmac.Equal([]byte(expected), []byte(fields[2])) {
+		return nil, ErrPermission
+	}
+	return akey, nil
+}
+
+// The body of HMAC signed request is verified by the content hash when it
+// was read to the end, the mismatched body fails with ErrPermission.
+type authHashReader struct {
+	reader io.ReadCloser
+	hash   hash.Hash
+	expect string
+	err    error
+}
+
+func (self *authHashReader) Read(p []byte) (int, error) {
+	n, err := self.reader.Read(p)
+	self.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(self.hash.Sum(nil)) != self.expect {
+		self.err = ErrPermission
+		return n, self.err
+	}
+	return n, err
+}
+
+func (self *authHashReader) Close() error {
+	return self.reader.Close()
+}
+
+// verifyContent wraps the body before the handler, the multipart body was
+// parsed before the authorization.
+func verifyContent(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if strings.HasPrefix(req.Header.Get("Authorization"), authHmacScheme+" ") {
+			req.Body = &authHashReader{
+				reader: req.Body,
+				hash:   sha256.New(),
+				expect: strings.ToLower(req.Header.Get(authContentHeader)),
+			}
+		}
+		handler.ServeHTTP(res, req)
+	})
+}
+
+// The part reader reads the rest of body at the end of part, so the content
+// hash is verified before the part was saved.
+type authPartReader struct {
+	reader io.Reader
+	body   io.Reader
+}
+
+func (self *authPartReader) Read(p []byte) (int, error) {
+	n, err := self.reader.Read(p)
+	if err == io.EOF {
+		if _, err := io.Copy(ioutil.Discard, self.body); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (self *AuthKey) allow(operation string, filepath string) bool {
+	if !self.Operations[operation] {
+		return false
+	}
+	if operation == AuthAdmin {
+		return true
+	}
+	for _, prefix := range self.Prefixes {
+		if strings.HasPrefix(filepath, prefix) || filepath+"/" == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks the operation on the file path by the presigned url or
+// the key. All requests are allowed when no key was defined, except the
+// private prefixes.
+func (self *HttpServer) authorize(req *http.Request, operation string, filepath string) error {
+	return self.authorizeMethod(req, req.Method, operation, filepath)
+}
+
+// authorizePrefix checks the private prefixes under the prefix too, so the
+// private files are not listed or moved by the requests without the key.
+func (self *HttpServer) authorizePrefix(req *http.Request, operation string, prefix string) error {
+	if err := self.authorize(req, operation, prefix); err != nil {
+		return err
+	}
+	return self.authorizePrivates(req, operation, prefix)
+}
+
+func (self *HttpServer) authorizePrivates(req *http.Request, operation string, prefix string) error {
+	for _, private := range self.config.AuthPrivates {
+		if strings.HasPrefix(private, prefix) {
+			if err := self.authorize(req, operation, private); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *HttpServer) authorizeMethod(req *http.Request, method string, operation string, filepath string) error {
+	if query := req.URL.Query(); len(query.Get("signature")) > 0 {
+		return self.verifyPresigned(query, method, operation, filepath)
+	}
+	if len(self.config.AuthKeys) < 1 && !self.isPrivate(filepath) {
+		return nil
+	}
+	akey, err := self.authenticate(req)
+	if err != nil {
+		return err
+	}
+	if akey == nil || !akey.allow(operation, filepath) {
+		return ErrPermission
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package tinynfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestHttpServerAuth(t *testing.T) {
+	srv := &HttpServer{
+		config: &Network{
+			AuthKeys: map[string]*AuthKey{
+				"uploader": &AuthKey{
+					Key:        "uploader",
+					Secret:     "secret",
+					Operations: map[string]bool{AuthRead: true, AuthWrite: true},
+					Prefixes:   []string{"/files/"},
+				},
+			},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/get?filepath=/files/a", nil)
+	if err := srv.authorize(req, AuthRead, "/files/a"); err != ErrPermission {
+		t.Error("Anonymous allowed", err)
+	}
+	req.SetBasicAuth("uploader", "secret")
+	if err := srv.authorize(req, AuthRead, "/files/a"); err != nil {
+		t.Error("Basic denied", err)
+	}
+	if err := srv.authorize(req, AuthRead, "/other/a"); err != ErrPermission {
+		t.Error("Prefix allowed", err)
+	}
+	if err := srv.authorize(req, AuthDelete, "/files/a"); err != ErrPermission {
+		t.Error("Operation allowed", err)
+	}
+	req.SetBasicAuth("uploader", "wrong")
+	if err := srv.authorize(req, AuthRead, "/files/a"); err != ErrPermission {
+		t.Error("Wrong secret allowed", err)
+	}
+
+	body := []byte("hello Auth")
+	hash := sha256.Sum256(body)
+	contentHash := hex.EncodeToString(hash[:])
+	req = httptest.NewRequest("POST", "/upload?filepath=/files/a", bytes.NewReader(body))
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := requestSignature("secret", "POST", "/upload?filepath=/files/a", timestamp, contentHash)
+	req.Header.Set("Authorization", "HMAC-SHA256 uploader:"+timestamp+":"+signature)
+	if err := srv.authorize(req, AuthWrite, "/files/a"); err != ErrPermission {
+		t.Error("HMAC without content hash allowed", err)
+	}
+	req.Header.Set(authContentHeader, contentHash)
+	if err := srv.authorize(req, AuthWrite, "/files/a"); err != nil {
+		t.Error("HMAC denied", err)
+	}
+	req = httptest.NewRequest("POST", "/delete?filepath=/files/a", nil)
+	req.Header.Set("Authorization", "HMAC-SHA256 uploader:"+timestamp+":"+signature)
+	req.Header.Set(authContentHeader, contentHash)
+	if err := srv.authorize(req, AuthWrite, "/files/a"); err != ErrPermission {
+		t.Error("HMAC replay allowed", err)
+	}
+
+	// The body is verified by the content hash
+	for _, data := range [][]byte{body, []byte("hello Evil")} {
+		req = httptest.NewRequest("POST", "/upload?filepath=/files/a", bytes.NewReader(data))
+		req.Header.Set("Authorization", "HMAC-SHA256 uploader:"+timestamp+":"+signature)
+		req.Header.Set(authContentHeader, contentHash)
+		var rerr error
+		verifyContent(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			_, rerr = ioutil.ReadAll(req.Body)
+		})).ServeHTTP(httptest.NewRecorder(), req)
+		if bytes.Equal(data, body) && rerr != nil {
+			t.Error("Content hash denied", rerr)
+		} else if !bytes.Equal(data, body) && rerr != ErrPermission {
+			t.Error("Content hash allowed", rerr)
+		}
+	}
+	t.Log("Auth success")
+}
+
+func TestHttpServerPresign(t *testing.T) {
+	akey := &AuthKey{
+		Key:        "reader",
+		Secret:     "secret",
+		Operations: map[string]bool{AuthRead: true},
+		Prefixes:   []string{"/private/"},
+	}
+	srv := &HttpServer{
+		config: &Network{
+			AuthKeys:     map[string]*AuthKey{},
+			AuthPrivates: []string{"/private/"},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/get?filepath=/public/a", nil)
+	if err := srv.authorize(req, AuthRead, "/public/a"); err != nil {
+		t.Error("Public denied", err)
+	}
+	req = httptest.NewRequest("GET", "/get?filepath=/private/a", nil)
+	if err := srv.authorize(req, AuthRead, "/private/a"); err != ErrPermission {
+		t.Error("Private allowed", err)
+	}
+
+	srv.config.AuthKeys[akey.Key] = akey
+	query := SignURL(akey, "GET", AuthRead, "/private/a", time.Now().Unix()+60)
+	req = httptest.NewRequest("HEAD", "/get?filepath=/private/a&"+query, nil)
+	if err := srv.authorize(req, AuthRead, "/private/a"); err != nil {
+		t.Error("Presigned denied", err)
+	}
+	req = httptest.NewRequest("GET", "/get?filepath=/private/b&"+query, nil)
+	if err := srv.authorize(req, AuthRead, "/private/b"); err != ErrPermission {
+		t.Error("Presigned other path allowed", err)
+	}
+	req = httptest.NewRequest("PUT", "/upload?filepath=/private/a&"+query, nil)
+	if err := srv.authorize(req, AuthWrite, "/private/a"); err != ErrPermission {
+		t.Error("Presigned other method allowed", err)
+	}
+	query = SignURL(akey, "GET", AuthRead, "/private/a", time.Now().Unix()-1)
+	req = httptest.NewRequest("GET", "/get?filepath=/private/a&"+query, nil)
+	if err := srv.authorize(req, AuthRead, "/private/a"); err != ErrPermission {
+		t.Error("Presigned expired allowed", err)
+	} else {
+		t.Log("Presign success")
+	}
+}
+
+func TestWebDAVAuthPrivate(t *testing.T) {
+	srv := &HttpServer{
+		config: &Network{
+			AuthKeys:     map[string]*AuthKey{},
+			AuthPrivates: []string{"/private/"},
+		},
+	}
+
+	req := httptest.NewRequest("GET", "/private/a", nil)
+	if err := srv.authorizeWebDAV(req); err != ErrPermission {
+		t.Error("Private allowed", err)
+	}
+	req = httptest.NewRequest("PUT", "/public/a", nil)
+	if err := srv.authorizeWebDAV(req); err != nil {
+		t.Error("Public denied", err)
+	}
+	req = httptest.NewRequest("DELETE", "/", nil)
+	if err := srv.authorizeWebDAV(req); err != ErrPermission {
+		t.Error("Delete private tree allowed", err)
+	}
+	req = httptest.NewRequest("MOVE", "/", nil)
+	req.Header.Set("Destination", "/other/")
+	if err := srv.authorizeWebDAV(req); err != ErrPermission {
+		t.Error("Move private tree allowed", err)
+	}
+
+	// The private entries are hidden from the anonymous
+	root := filepath.Join("../../test", "data-fs-webdav-auth")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+	for _, name := range []string{"/private/a", "/public/a", "/b"} {
+		if err := fs.WriteFile(name, "text/plain", "", fsTestBuffer, nil); err != nil {
+			t.Fatal("WriteFile error", err)
+		}
+	}
+	req = httptest.NewRequest("PROPFIND", "/", nil)
+	ctx := context.WithValue(context.Background(), davAllowKey{}, func(name string) bool {
+		return srv.authorize(req, AuthRead, name) == nil
+	})
+	dav := &davFileSystem{storage: fs, dirs: map[string]bool{}}
+	dir, err := dav.OpenFile(ctx, "/", os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal("Open dir error", err)
+	}
+	infos, err := dir.Readdir(0)
+	if err != nil {
+		t.Fatal("Readdir error", err)
+	}
+	names := []string{}
+	for _, v := range infos {
+		names = append(names, v.(*davFileInfo).name)
+	}
+	if len(names) != 2 || names[0] != "/b" || names[1] != "/public" {
+		t.Error("Readdir private listed", names)
+	} else {
+		t.Log("WebDAV auth success")
+	}
+}
@@ -2,22 +2,49 @@ package tinynfs
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"os"
+	"path"
+	"strconv"
 	"strings"
+	"time"
 )
 
 func (self *HttpServer) startFile() {
 	var (
 		serveMux = http.NewServeMux()
 		server   = &http.Server{
-			Handler: serveMux,
+			Handler: verifyContent(serveMux),
 		}
 	)
 	serveMux.HandleFunc("/get", self.handleFileGet)
 	serveMux.HandleFunc("/upload", self.handleFileUpload)
+	serveMux.HandleFunc("/upload/create", self.handleUploadCreate)
+	serveMux.HandleFunc("/upload/chunk", self.handleUploadChunk)
+	serveMux.HandleFunc("/upload/status", self.handleUploadStatus)
+	serveMux.HandleFunc("/upload/commit", self.handleUploadCommit)
+	serveMux.HandleFunc("/upload/abort", self.handleUploadAbort)
 	serveMux.HandleFunc("/delete", self.handleFileDelete)
+	serveMux.HandleFunc("/undelete", self.handleFileUndelete)
+	serveMux.HandleFunc("/trash", self.handleFileTrash)
+	serveMux.HandleFunc("/versions", self.handleFileVersions)
+	serveMux.HandleFunc("/versions/restore", self.handleFileVersionRestore)
+	serveMux.HandleFunc("/move", self.handleFileMove)
+	serveMux.HandleFunc("/copy", self.handleFileCopy)
+	serveMux.HandleFunc("/stat", self.handleFileStat)
+	serveMux.HandleFunc("/list", self.handleFileList)
+	serveMux.HandleFunc("/presign", self.handleFilePresign)
 	serveMux.HandleFunc("/admin/snapshot", self.handleAdminSnapshot)
+	serveMux.HandleFunc("/admin/compact", self.handleAdminCompact)
+	serveMux.HandleFunc("/admin/hash", self.handleAdminHash)
+	serveMux.HandleFunc("/admin/repair", self.handleAdminRepair)
+	serveMux.HandleFunc("/admin/scrub", self.handleAdminScrub)
+	serveMux.HandleFunc("/admin/replicas", self.handleAdminReplicas)
+	serveMux.HandleFunc("/admin/drain", self.handleAdminDrain)
+	serveMux.HandleFunc("/admin/readonly", self.handleAdminReadOnly)
 	err := server.Serve(self.fileListener)
 	if err != nil && !self.closed {
 		fmt.Println(err)
@@ -32,27 +59,67 @@ func (self *HttpServer) handleFileGet(res http.ResponseWriter, req *http.Request
 
 	var (
 		xerr  error
-		xmime string
-		xdata []byte
+		xfile *FileReader
 	)
-	defer self.sendByteData(res, req, &xerr, &xmime, &xdata)
+	defer self.sendFileData(res, req, &xerr, &xfile)
 
 	filepath := req.FormValue("filepath")
 	if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
 		xerr = ErrParam
 		return
 	}
+	if err := self.authorize(req, AuthRead, filepath); err != nil {
+		xerr = err
+		return
+	}
+	version, err := parseVersion(req.FormValue("version"))
+	if err != nil {
+		xerr = err
+		return
+	}
+	download := false
+	if v := req.FormValue("download"); len(v) > 0 {
+		if download, err = strconv.ParseBool(v); err != nil {
+			xerr = ErrParam
+			return
+		}
+	}
 
-	filemime, _, filedata, err := self.storage.ReadFile(filepath)
+	var file *FileReader
+	if req.Method == "HEAD" {
+		// Send the headers only, without reading the volume
+		fnode, err := self.statVersion(filepath, version)
+		if err != nil {
+			xerr = err
+			return
+		}
+		file = newHeadFileReader(fnode)
+	} else if version > 0 {
+		file, err = self.storage.OpenFileVersion(filepath, version)
+	} else {
+		file, err = self.storage.OpenFile(filepath)
+	}
 	if err != nil {
 		xerr = err
 		return
 	}
-	xmime = filemime
-	xdata = filedata
+	// The filename of request overrides the original filename
+	filename := req.FormValue("filename")
+	if len(filename) < 1 {
+		filename = file.Node.Filename
+	}
+	if download && len(filename) < 1 {
+		filename = path.Base(filepath)
+	}
+	if download {
+		res.Header().Set("Content-Disposition", contentDisposition("attachment", filename))
+	} else if len(filename) > 0 {
+		res.Header().Set("Content-Disposition", contentDisposition("inline", filename))
+	}
+	xfile = file
 }
 
-func (self *HttpServer) handleFileUpload(res http.ResponseWriter, req *http.Request) {
+func (self *HttpServer) handleFileMove(res http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" && req.Method != "PUT" {
 		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
 		return
@@ -70,32 +137,322 @@ func (self *HttpServer) handleFileUpload(res http.ResponseWriter, req *http.Requ
 	}
 
 	filepath := req.FormValue("filepath")
+	target := req.FormValue("target")
+	if !strings.HasPrefix(filepath, "/") || !strings.HasPrefix(target, "/") {
+		xerr = ErrParam
+		return
+	}
+
+	if err := self.authorizePrefix(req, AuthDelete, filepath); err != nil {
+		xerr = err
+		return
+	}
+	if err := self.authorize(req, AuthWrite, target); err != nil {
+		xerr = err
+		return
+	}
+
+	count := 1
+	if strings.HasSuffix(filepath, "/") {
+		// Rename the directory
+		n, err := self.storage.RenamePrefix(filepath, target, req.Method == "PUT")
+		if err != nil {
+			xerr = err
+			return
+		}
+		count = n
+	} else {
+		if strings.HasSuffix(target, "/") {
+			xerr = ErrParam
+			return
+		}
+		if err := self.storage.Rename(filepath, target, req.Method == "PUT"); err != nil {
+			xerr = err
+			return
+		}
+	}
+	xdata["filepath"] = filepath
+	xdata["target"] = target
+	xdata["count"] = count
+}
+
+func (self *HttpServer) handleFileCopy(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && req.Method != "PUT" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.parseRequestBody(req); err != nil {
+		xerr = err
+		return
+	}
+
+	filepath := req.FormValue("filepath")
+	target := req.FormValue("target")
 	if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
 		xerr = ErrParam
 		return
 	}
+	if !strings.HasPrefix(target, "/") || strings.HasSuffix(target, "/") {
+		xerr = ErrParam
+		return
+	}
 
-	datafile, dataheader, err := req.FormFile("filedata")
-	if err != nil {
+	if err := self.authorize(req, AuthRead, filepath); err != nil {
+		xerr = err
+		return
+	}
+	if err := self.authorize(req, AuthWrite, target); err != nil {
+		xerr = err
+		return
+	}
+
+	if err := self.storage.Copy(filepath, target, req.Method == "PUT"); err != nil {
+		xerr = err
+		return
+	}
+	xdata["filepath"] = filepath
+	xdata["target"] = target
+}
+
+func (self *HttpServer) handleFileStat(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	filepath := req.FormValue("filepath")
+	if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
 		xerr = ErrParam
 		return
 	}
-	filedata, err := ioutil.ReadAll(datafile)
+
+	if err := self.authorize(req, AuthRead, filepath); err != nil {
+		xerr = err
+		return
+	}
+
+	version, err := parseVersion(req.FormValue("version"))
 	if err != nil {
 		xerr = err
 		return
 	}
-	filemime := dataheader.Header.Get("Content-Type")
-	err = self.storage.WriteFile(filepath, filemime, "", filedata, &WriteOptions{
-		Overwrite: req.Method == "PUT",
-	})
+	fnode, err := self.statVersion(filepath, version)
 	if err != nil {
 		xerr = err
 		return
 	}
-	xdata["size"] = len(filedata)
+	xdata["filepath"] = filepath
+	xdata["size"] = fnode.Size
+	xdata["mime"] = fnode.Mime
+	xdata["metadata"] = fnode.Metadata
+	xdata["hash"] = fnode.Hash
+	xdata["group_id"] = fnode.GroupId
+	xdata["created"] = fnode.Created
+	xdata["expires"] = fnode.Expires
+	xdata["version"] = fnode.versionId()
+	xdata["filename"] = fnode.Filename
+	if fnode.Meta != nil {
+		xdata["meta"] = fnode.Meta
+	} else {
+		xdata["meta"] = map[string]string{}
+	}
+}
+
+func (self *HttpServer) handleFileUpload(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && req.Method != "PUT" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	var (
+		filesize int64
+		filemime string
+		filepath = req.URL.Query().Get("filepath")
+		options  = &WriteOptions{
+			Overwrite: req.Method == "PUT",
+		}
+	)
+	expires, err := parseTTL(req.URL.Query().Get("ttl"))
+	if err != nil {
+		xerr = err
+		return
+	}
+	options.Expires = expires
+	options.Filename = req.URL.Query().Get("filename")
+	if options.Meta, err = parseMeta(req); err != nil {
+		xerr = err
+		return
+	}
+	mediatype, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediatype != "multipart/form-data" {
+		// The request body is file data
+		if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
+			xerr = ErrParam
+			return
+		}
+		if err := self.authorize(req, AuthWrite, filepath); err != nil {
+			xerr = err
+			return
+		}
+		filemime = req.Header.Get("Content-Type")
+		size, err := self.storage.WriteStream(filepath, filemime, "", req.Body, options)
+		if err != nil {
+			xerr = err
+			return
+		}
+		filesize = size
+	} else {
+		reader, err := req.MultipartReader()
+		if err != nil {
+			xerr = ErrParam
+			return
+		}
+		// The filedata sent before filepath is saved to temporary file
+		var spill *os.File
+		defer func() {
+			if spill != nil {
+				spill.Close()
+				os.Remove(spill.Name())
+			}
+		}()
+		written := false
+		for !written {
+			part, err := reader.NextPart()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				xerr = err
+				return
+			}
+			switch part.FormName() {
+			case "filepath":
+				value, err := ioutil.ReadAll(io.LimitReader(part, 4096))
+				if err != nil {
+					xerr = err
+					return
+				}
+				filepath = string(value)
+			case "filename":
+				value, err := ioutil.ReadAll(io.LimitReader(part, 4096))
+				if err != nil {
+					xerr = err
+					return
+				}
+				options.Filename = string(value)
+			case "ttl":
+				value, err := ioutil.ReadAll(io.LimitReader(part, 32))
+				if err != nil {
+					xerr = err
+					return
+				}
+				if options.Expires, err = parseTTL(string(value)); err != nil {
+					xerr = err
+					return
+				}
+			default:
+				if !strings.HasPrefix(part.FormName(), metaFormPrefix) {
+					break
+				}
+				value, err := ioutil.ReadAll(io.LimitReader(part, metaMaxSize+1))
+				if err != nil {
+					xerr = err
+					return
+				}
+				if options.Meta == nil {
+					options.Meta = map[string]string{}
+				}
+				if err := addMeta(options.Meta, part.FormName()[len(metaFormPrefix):], string(value)); err != nil {
+					xerr = err
+					return
+				}
+			case "filedata":
+				if spill != nil {
+					xerr = ErrParam
+					return
+				}
+				filemime = part.Header.Get("Content-Type")
+				if len(options.Filename) < 1 {
+					options.Filename = part.FileName()
+				}
+				if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
+					if spill, err = self.storage.createTempFile("upload-"); err != nil {
+						xerr = err
+						return
+					}
+					if _, err := io.Copy(spill, part); err != nil {
+						xerr = err
+						return
+					}
+					break
+				}
+				if err := self.authorize(req, AuthWrite, filepath); err != nil {
+					xerr = err
+					return
+				}
+				size, err := self.storage.WriteStream(filepath, filemime, "", &authPartReader{part, req.Body}, options)
+				if err != nil {
+					xerr = err
+					return
+				}
+				filesize = size
+				written = true
+			}
+			part.Close()
+		}
+		if !written && spill != nil {
+			if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
+				xerr = ErrParam
+				return
+			}
+			if err := self.authorize(req, AuthWrite, filepath); err != nil {
+				xerr = err
+				return
+			}
+			// The rest of body is read for the content hash verification
+			if _, err := io.Copy(ioutil.Discard, req.Body); err != nil {
+				xerr = err
+				return
+			}
+			if _, err := spill.Seek(0, io.SeekStart); err != nil {
+				xerr = err
+				return
+			}
+			size, err := self.storage.WriteStream(filepath, filemime, "", spill, options)
+			if err != nil {
+				xerr = err
+				return
+			}
+			filesize = size
+			written = true
+		}
+		if !written {
+			xerr = ErrParam
+			return
+		}
+	}
+	xdata["size"] = filesize
 	xdata["mime"] = filemime
 	xdata["filepath"] = filepath
+	xdata["expires"] = options.Expires
 }
 
 func (self *HttpServer) handleFileDelete(res http.ResponseWriter, req *http.Request) {
@@ -121,6 +478,11 @@ func (self *HttpServer) handleFileDelete(res http.ResponseWriter, req *http.Requ
 		return
 	}
 
+	if err := self.authorize(req, AuthDelete, filepath); err != nil {
+		xerr = err
+		return
+	}
+
 	err := self.storage.DeleteFile(filepath)
 	if err != nil {
 		xerr = err
@@ -129,6 +491,270 @@ func (self *HttpServer) handleFileDelete(res http.ResponseWriter, req *http.Requ
 	xdata["filepath"] = filepath
 }
 
+func (self *HttpServer) handleFileUndelete(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && req.Method != "PUT" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.parseRequestBody(req); err != nil {
+		xerr = err
+		return
+	}
+
+	filepath := req.FormValue("filepath")
+	if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
+		xerr = ErrParam
+		return
+	}
+
+	if err := self.authorize(req, AuthWrite, filepath); err != nil {
+		xerr = err
+		return
+	}
+
+	fnode, err := self.storage.Undelete(filepath, req.Method == "PUT")
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["filepath"] = filepath
+	xdata["size"] = fnode.Size
+	xdata["mime"] = fnode.Mime
+}
+
+func (self *HttpServer) handleFileTrash(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	prefix := req.FormValue("prefix")
+	if len(prefix) < 1 {
+		prefix = "/"
+	} else if !strings.HasPrefix(prefix, "/") {
+		xerr = ErrParam
+		return
+	}
+	if err := self.authorizePrefix(req, AuthRead, prefix); err != nil {
+		xerr = err
+		return
+	}
+	limit := 0
+	if v := req.FormValue("limit"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			xerr = ErrParam
+			return
+		}
+		limit = n
+	}
+
+	result, err := self.storage.ListTrash(prefix, req.FormValue("cursor"), limit)
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["prefix"] = prefix
+	xdata["files"] = result.Files
+	xdata["cursor"] = result.Cursor
+}
+
+func (self *HttpServer) handleFileVersions(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	filepath := req.FormValue("filepath")
+	if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
+		xerr = ErrParam
+		return
+	}
+	if err := self.authorize(req, AuthRead, filepath); err != nil {
+		xerr = err
+		return
+	}
+
+	versions, err := self.storage.ListVersions(filepath)
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["filepath"] = filepath
+	xdata["versions"] = versions
+}
+
+func (self *HttpServer) handleFileVersionRestore(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.parseRequestBody(req); err != nil {
+		xerr = err
+		return
+	}
+
+	filepath := req.FormValue("filepath")
+	if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
+		xerr = ErrParam
+		return
+	}
+	version, err := parseVersion(req.FormValue("version"))
+	if err != nil || version < 1 {
+		xerr = ErrParam
+		return
+	}
+	if err := self.authorize(req, AuthWrite, filepath); err != nil {
+		xerr = err
+		return
+	}
+
+	fnode, err := self.storage.RestoreVersion(filepath, version)
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["filepath"] = filepath
+	xdata["size"] = fnode.Size
+	xdata["mime"] = fnode.Mime
+	xdata["version"] = fnode.Version
+}
+
+func (self *HttpServer) handleFileList(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	prefix := req.FormValue("prefix")
+	if len(prefix) < 1 {
+		prefix = "/"
+	} else if !strings.HasPrefix(prefix, "/") {
+		xerr = ErrParam
+		return
+	}
+	if err := self.authorizePrefix(req, AuthRead, prefix); err != nil {
+		xerr = err
+		return
+	}
+	limit := 0
+	if v := req.FormValue("limit"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			xerr = ErrParam
+			return
+		}
+		limit = n
+	}
+
+	result, err := self.storage.List(prefix, req.FormValue("delimiter"), req.FormValue("cursor"), limit)
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["prefix"] = prefix
+	xdata["files"] = result.Files
+	xdata["prefixes"] = result.Prefixes
+	xdata["cursor"] = result.Cursor
+}
+
+func (self *HttpServer) handleFilePresign(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	filepath := req.FormValue("filepath")
+	if !strings.HasPrefix(filepath, "/") {
+		xerr = ErrParam
+		return
+	}
+	method := strings.ToUpper(req.FormValue("method"))
+	operation := req.FormValue("operation")
+	switch method {
+	case "", "GET":
+		method = "GET"
+		if len(operation) < 1 {
+			operation = AuthRead
+		}
+	case "POST", "PUT":
+		if len(operation) < 1 {
+			operation = AuthWrite
+		}
+	default:
+		xerr = ErrParam
+		return
+	}
+	if operation != AuthRead && operation != AuthWrite && operation != AuthDelete {
+		xerr = ErrParam
+		return
+	}
+	expires := int64(3600)
+	if v := req.FormValue("expires"); len(v) > 0 {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 1 || n > authMaxPresignTime {
+			xerr = ErrParam
+			return
+		}
+		expires = n
+	}
+
+	// The presigned url is minted by the key of request
+	akey, err := self.authenticate(req)
+	if err != nil {
+		xerr = err
+		return
+	}
+	if akey == nil || !akey.allow(operation, filepath) {
+		xerr = ErrPermission
+		return
+	}
+	expires += time.Now().Unix()
+	xdata["filepath"] = filepath
+	xdata["method"] = method
+	xdata["operation"] = operation
+	xdata["expires"] = expires
+	xdata["query"] = SignURL(akey, method, operation, filepath, expires)
+}
+
 func (self *HttpServer) handleAdminSnapshot(res http.ResponseWriter, req *http.Request) {
 	if req.Method != "POST" {
 		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
@@ -141,6 +767,11 @@ func (self *HttpServer) handleAdminSnapshot(res http.ResponseWriter, req *http.R
 	)
 	defer self.sendJsonData(res, req, &xerr, xdata)
 
+	if err := self.authorize(req, AuthAdmin, ""); err != nil {
+		xerr = err
+		return
+	}
+
 	ssfile, err := self.storage.Snapshot(true)
 	if err != nil {
 		xerr = err
@@ -148,3 +779,223 @@ func (self *HttpServer) handleAdminSnapshot(res http.ResponseWriter, req *http.R
 	}
 	xdata["filename"] = ssfile
 }
+
+func (self *HttpServer) handleAdminCompact(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.authorize(req, AuthAdmin, ""); err != nil {
+		xerr = err
+		return
+	}
+
+	results, err := self.storage.Compact(true)
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["volumes"] = results
+}
+
+func (self *HttpServer) handleAdminHash(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.authorize(req, AuthAdmin, ""); err != nil {
+		xerr = err
+		return
+	}
+
+	hstat, err := self.storage.StatHash(req.FormValue("hash"))
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["hash"] = hstat.Hash
+	xdata["size"] = hstat.Size
+	xdata["refs"] = hstat.Refs
+	xdata["group_id"] = hstat.GroupId
+	xdata["volume_id"] = hstat.VolumeId
+	xdata["volume_offset"] = hstat.VolumeOffset
+	xdata["replicas"] = hstat.Replicas
+}
+
+func (self *HttpServer) handleAdminRepair(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.authorize(req, AuthAdmin, ""); err != nil {
+		xerr = err
+		return
+	}
+
+	result, err := self.storage.RepairRefs()
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["files"] = result.Files
+	xdata["hashs"] = result.Hashs
+	xdata["fixed"] = result.Fixed
+	xdata["orphans"] = result.Orphans
+}
+
+func (self *HttpServer) handleAdminScrub(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.authorize(req, AuthAdmin, ""); err != nil {
+		xerr = err
+		return
+	}
+
+	// Start the scrub in background, the status is got by GET
+	if req.Method == "POST" {
+		if err := self.storage.StartScrub(); err != nil {
+			xerr = err
+			return
+		}
+	}
+	corrupted, err := self.storage.ListCorrupted()
+	if err != nil {
+		xerr = err
+		return
+	}
+	running, result := self.storage.ScrubStatus()
+	xdata["running"] = running
+	xdata["last"] = result
+	xdata["corrupted"] = corrupted
+}
+
+func (self *HttpServer) handleAdminReplicas(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.authorize(req, AuthAdmin, ""); err != nil {
+		xerr = err
+		return
+	}
+
+	result, err := self.storage.RepairReplicas()
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["hashs"] = result.Hashs
+	xdata["created"] = result.Created
+	xdata["promoted"] = result.Promoted
+	xdata["lost"] = result.Lost
+}
+
+func (self *HttpServer) handleAdminDrain(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" && req.Method != "DELETE" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.authorize(req, AuthAdmin, ""); err != nil {
+		xerr = err
+		return
+	}
+
+	groupId, err := strconv.Atoi(req.FormValue("group"))
+	if err != nil {
+		xerr = ErrParam
+		return
+	}
+	// Start the drain in background, the status is got by GET
+	if req.Method == "POST" {
+		err = self.storage.StartDrain(groupId)
+	} else if req.Method == "DELETE" {
+		err = self.storage.CancelDrain(groupId)
+	}
+	if err != nil {
+		xerr = err
+		return
+	}
+	status, err := self.storage.DrainStatus(groupId)
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["group_id"] = status.GroupId
+	xdata["draining"] = status.Draining
+	xdata["running"] = status.Running
+	xdata["remaining"] = status.Remaining
+	xdata["removable"] = status.Removable
+	xdata["last"] = status.Last
+}
+
+func (self *HttpServer) handleAdminReadOnly(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "POST" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.authorize(req, AuthAdmin, ""); err != nil {
+		xerr = err
+		return
+	}
+
+	if req.Method == "POST" {
+		readOnly, err := strconv.ParseBool(req.FormValue("readonly"))
+		if err != nil {
+			xerr = ErrParam
+			return
+		}
+		self.storage.SetReadOnly(readOnly)
+	}
+	xdata["readonly"] = self.storage.IsReadOnly()
+}
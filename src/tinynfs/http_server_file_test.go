@@ -0,0 +1,288 @@
+package tinynfs
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestFileUploadOrder(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-upload-order")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	srv := &HttpServer{
+		config:  &Network{},
+		storage: fs,
+	}
+	for i, name := range []string{"/upload/a", "/upload/b"} {
+		body := &bytes.Buffer{}
+		form := multipart.NewWriter(body)
+		if i == 0 {
+			form.WriteField("filepath", name)
+		}
+		fw, _ := form.CreateFormFile("filedata", "a.txt")
+		fw.Write(fsTestBuffer)
+		if i == 1 {
+			form.WriteField("filepath", name)
+		}
+		form.Close()
+
+		req := httptest.NewRequest("POST", "/upload", body)
+		req.Header.Set("Content-Type", form.FormDataContentType())
+		res := httptest.NewRecorder()
+		srv.handleFileUpload(res, req)
+		if res.Code != 200 {
+			t.Error("Upload error", name, res.Body.String())
+		}
+		if _, _, data, err := fs.ReadFile(name); err != nil || !bytes.Equal(data, fsTestBuffer) {
+			t.Error("Upload mismatch", name, err)
+		}
+	}
+
+	body := &bytes.Buffer{}
+	form := multipart.NewWriter(body)
+	fw, _ := form.CreateFormFile("filedata", "a.txt")
+	fw.Write(fsTestBuffer)
+	form.Close()
+	req := httptest.NewRequest("POST", "/upload", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	res := httptest.NewRecorder()
+	srv.handleFileUpload(res, req)
+	if res.Code != 400 {
+		t.Error("Upload without filepath", res.Code, res.Body.String())
+	} else {
+		t.Log("Upload order success")
+	}
+}
+
+func TestFileListPrivate(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-list-private")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	srv := &HttpServer{
+		config: &Network{
+			AuthPrivates: []string{"/private/"},
+		},
+		storage: fs,
+	}
+	for _, name := range []string{"/private/a", "/public/a"} {
+		if err := fs.WriteFile(name, "text/plain", "", fsTestBuffer, nil); err != nil {
+			t.Fatal("WriteFile error", err)
+		}
+	}
+	for _, uri := range []string{"/list?prefix=/", "/list?prefix=/pri", "/trash?prefix=/"} {
+		res := httptest.NewRecorder()
+		if strings.HasPrefix(uri, "/trash") {
+			srv.handleFileTrash(res, httptest.NewRequest("GET", uri, nil))
+		} else {
+			srv.handleFileList(res, httptest.NewRequest("GET", uri, nil))
+		}
+		if res.Code != 403 || strings.Contains(res.Body.String(), "/private/a") {
+			t.Error("List private allowed", uri, res.Body.String())
+		}
+	}
+	res := httptest.NewRecorder()
+	srv.handleFileList(res, httptest.NewRequest("GET", "/list?prefix=/public/", nil))
+	if res.Code != 200 || !strings.Contains(res.Body.String(), "/public/a") {
+		t.Error("List public denied", res.Body.String())
+	} else {
+		t.Log("List private success")
+	}
+}
+
+func TestFileGetRange(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-range")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	srv := &HttpServer{
+		config: &Network{
+			ImageThumbnailSizes: map[string]bool{"1x1": true},
+		},
+		storage: fs,
+	}
+	if err := fs.WriteFile("/range/a", "text/plain", "", fsTestBuffer, nil); err != nil {
+		t.Fatal("WriteFile error", err)
+	}
+	if err := fs.WriteFile("/range/b", "image/png", "1x1", tinyPNG, nil); err != nil {
+		t.Fatal("WriteFile error", err)
+	}
+
+	for _, v := range []struct {
+		uri    string
+		data   []byte
+		handle func(http.ResponseWriter, *http.Request)
+	}{
+		{"/get?filepath=/range/a", fsTestBuffer, srv.handleFileGet},
+		{"/range/b", tinyPNG, srv.handleImageGet},
+		{"/range/b_1x1", nil, srv.handleImageGet},
+	} {
+		get := func(headers map[string]string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", v.uri, nil)
+			for k, h := range headers {
+				req.Header.Set(k, h)
+			}
+			res := httptest.NewRecorder()
+			v.handle(res, req)
+			return res
+		}
+		res := get(nil)
+		etag := res.Header().Get("ETag")
+		if v.data == nil {
+			// The thumbnail is scaled by the first request
+			v.data = res.Body.Bytes()
+		}
+		if res.Code != 200 || len(etag) < 1 || !bytes.Equal(res.Body.Bytes(), v.data) {
+			t.Error("Get error", v.uri, res.Code, etag)
+		}
+		res = get(map[string]string{"Range": "bytes=0-4"})
+		if res.Code != 206 || res.Header().Get("Content-Range") != fmt.Sprintf("bytes 0-4/%d", len(v.data)) || !bytes.Equal(res.Body.Bytes(), v.data[:5]) {
+			t.Error("Range error", v.uri, res.Code, res.Header().Get("Content-Range"))
+		}
+		res = get(map[string]string{"If-None-Match": etag})
+		if res.Code != 304 {
+			t.Error("If-None-Match error", v.uri, res.Code)
+		}
+		res = get(map[string]string{"Range": "bytes=0-4", "If-Range": "\"stale\""})
+		if res.Code != 200 || !bytes.Equal(res.Body.Bytes(), v.data) {
+			t.Error("If-Range stale error", v.uri, res.Code)
+		}
+		res = get(map[string]string{"Range": "bytes=0-4", "If-Range": etag})
+		if res.Code != 206 {
+			t.Error("If-Range error", v.uri, res.Code)
+		}
+		res = get(map[string]string{"Range": fmt.Sprintf("bytes=%d-", len(v.data)+10)})
+		if res.Code != 416 {
+			t.Error("Range unsatisfiable error", v.uri, res.Code)
+		}
+	}
+	t.Log("Get range success")
+}
+
+func TestFileStatWithoutVolume(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-stat")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	srv := &HttpServer{
+		config:  &Network{},
+		storage: fs,
+	}
+	options := &WriteOptions{Meta: map[string]string{"owner": "tester"}}
+	if err := fs.WriteFile("/stat/a", "text/plain", "", fsTestBuffer, options); err != nil {
+		t.Fatal("WriteFile error", err)
+	}
+	fnode, err := fs.Stat("/stat/a")
+	if err != nil {
+		t.Fatal("Stat error", err)
+	}
+
+	// The stat and HEAD never read the volume
+	files, _ := filepath.Glob(filepath.Join(root, "volumes", "volume-*"))
+	for _, v := range files {
+		if err := os.Truncate(v, 0); err != nil {
+			t.Fatal("Truncate error", err)
+		}
+	}
+	if _, _, _, err := fs.ReadFile("/stat/a"); err == nil {
+		t.Error("Read truncated volume")
+	}
+
+	res := httptest.NewRecorder()
+	srv.handleFileStat(res, httptest.NewRequest("GET", "/stat?filepath=/stat/a", nil))
+	var stat struct {
+		Code int `json:"code"`
+		Data struct {
+			Size int               `json:"size"`
+			Mime string            `json:"mime"`
+			Hash string            `json:"hash"`
+			Meta map[string]string `json:"meta"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(res.Body.Bytes(), &stat); err != nil || stat.Code != 0 {
+		t.Error("Stat error", res.Body.String())
+	} else if stat.Data.Size != len(fsTestBuffer) || stat.Data.Mime != "text/plain" || stat.Data.Hash != fnode.Hash || stat.Data.Meta["owner"] != "tester" {
+		t.Error("Stat mismatch", res.Body.String())
+	}
+
+	res = httptest.NewRecorder()
+	srv.handleFileGet(res, httptest.NewRequest("HEAD", "/get?filepath=/stat/a", nil))
+	header := res.Header()
+	if res.Code != 200 || header.Get("Content-Length") != strconv.Itoa(len(fsTestBuffer)) || header.Get("Content-Type") != "text/plain" {
+		t.Error("HEAD error", res.Code, header)
+	} else if header.Get("ETag") != "\""+fnode.Hash+"\"" || header.Get(metaHeaderPrefix+"Owner") != "tester" {
+		t.Error("HEAD mismatch", header)
+	} else {
+		t.Log("Stat without volume success")
+	}
+}
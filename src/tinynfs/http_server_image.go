@@ -20,7 +20,7 @@ func (self *HttpServer) startImage() {
 	var (
 		serveMux = http.NewServeMux()
 		server   = &http.Server{
-			Handler: serveMux,
+			Handler: verifyContent(serveMux),
 		}
 	)
 	serveMux.HandleFunc("/", self.handleImageGet)
@@ -63,9 +63,17 @@ func (self *HttpServer) handleImageGet(res http.ResponseWriter, req *http.Reques
 	var (
 		xerr  error
 		xmime string
+		xnode *FileNode
 		xdata []byte
+		xfile *FileReader
 	)
-	defer self.sendByteData(res, req, &xerr, &xmime, &xdata)
+	defer func() {
+		if xfile != nil {
+			self.sendFileData(res, req, &xerr, &xfile)
+		} else {
+			self.sendByteData(res, req, &xerr, &xmime, &xnode, &xdata)
+		}
+	}()
 
 	filepath := req.URL.Path
 	if strings.HasSuffix(filepath, "/") {
@@ -74,12 +82,10 @@ func (self *HttpServer) handleImageGet(res http.ResponseWriter, req *http.Reques
 	}
 
 	var (
-		err        error
 		awidth     int
 		aheight    int
 		mimedata   string
 		metadata   string
-		imagedata  []byte
 		originpath string
 	)
 
@@ -98,11 +104,20 @@ func (self *HttpServer) handleImageGet(res http.ResponseWriter, req *http.Reques
 		originpath = filepath[:n]
 	}
 
+	// The thumbnail is authorized by the origin file
+	authpath := filepath
+	if len(originpath) > 0 {
+		authpath = originpath
+	}
+	if err := self.authorize(req, AuthRead, authpath); err != nil {
+		xerr = err
+		return
+	}
+
 	// Read thumbnail file
-	mimedata, metadata, imagedata, err = self.storage.ReadFile(filepath)
+	file, err := self.storage.OpenFile(filepath)
 	if err == nil {
-		xmime = mimedata
-		xdata = imagedata
+		xfile = file
 		return
 	} else if err != ErrNotExist || len(originpath) < 1 {
 		xerr = err
@@ -110,20 +125,26 @@ func (self *HttpServer) handleImageGet(res http.ResponseWriter, req *http.Reques
 	}
 
 	// Read origin file
-	mimedata, metadata, imagedata, err = self.storage.ReadFile(originpath)
+	file, err = self.storage.OpenFile(originpath)
 	if err != nil {
 		xerr = err
 		return
 	}
-	owidth, oheight := self.parseImageSize(metadata)
+	owidth, oheight := self.parseImageSize(file.Node.Metadata)
 	if owidth == 0 || oheight == 0 {
+		file.Close()
 		xerr = ErrThumbnailSize
 		return
 	}
 	// Ignore image scale
 	if owidth < awidth && oheight < aheight {
-		xmime = mimedata
-		xdata = imagedata
+		xfile = file
+		return
+	}
+	imagedata, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil {
+		xerr = err
 		return
 	}
 
@@ -136,18 +157,28 @@ func (self *HttpServer) handleImageGet(res http.ResponseWriter, req *http.Reques
 	mimedata = "image/" + format
 	metadata = fmt.Sprintf("%dx%d", width, height)
 	filepath = fmt.Sprintf("%s_%dx%d", originpath, awidth, aheight)
+	// The thumbnail expires with the origin file
 	options := &WriteOptions{
 		Overwrite: false,
+		Expires:   file.Node.Expires,
 	}
-	if err := self.storage.WriteFile(filepath, mimedata, metadata, imagedata, options); err != nil && err != ErrExist {
-		xerr = err
-		return
+	// The thumbnail is served without saving in read-only mode, by the origin
+	// file node
+	xnode = file.Node
+	if !self.storage.IsReadOnly() {
+		if err := self.storage.WriteFile(filepath, mimedata, metadata, imagedata, options); err != nil && err != ErrExist {
+			xerr = err
+			return
+		}
+		if fnode, err := self.storage.Stat(filepath); err == nil {
+			xnode = fnode
+		}
 	}
 	xmime = mimedata
 	xdata = imagedata
 }
 
-func (self *HttpServer) saveImageToStorage(stream io.Reader) (map[string]interface{}, error) {
+func (self *HttpServer) saveImageToStorage(stream io.Reader, expires int64) (map[string]interface{}, error) {
 	imagedata, err := ioutil.ReadAll(stream)
 	if err != nil {
 		return nil, err
@@ -161,7 +192,11 @@ func (self *HttpServer) saveImageToStorage(stream io.Reader) (map[string]interfa
 	mimedata := "image/" + format
 	metadata := fmt.Sprintf("%dx%d", width, height)
 	filepath := self.getImageFilePath()
-	if err := self.storage.WriteFile(filepath, mimedata, metadata, imagedata, nil); err != nil {
+	options := &WriteOptions{
+		Overwrite: true,
+		Expires:   expires,
+	}
+	if err := self.storage.WriteFile(filepath, mimedata, metadata, imagedata, options); err != nil {
 		return nil, err
 	}
 
@@ -171,6 +206,7 @@ func (self *HttpServer) saveImageToStorage(stream io.Reader) (map[string]interfa
 	imageout["width"] = width
 	imageout["height"] = height
 	imageout["image_url"] = filepath
+	imageout["expires"] = expires
 	return imageout, nil
 }
 
@@ -186,17 +222,26 @@ func (self *HttpServer) handleImageUpload(res http.ResponseWriter, req *http.Req
 	)
 	defer self.sendJsonData(res, req, &xerr, xdata)
 
+	if err := self.authorize(req, AuthWrite, self.config.ImageFilePath); err != nil {
+		xerr = err
+		return
+	}
 	if err := self.parseRequestBody(req); err != nil {
 		xerr = err
 		return
 	}
 
+	expires, err := parseTTL(req.FormValue("ttl"))
+	if err != nil {
+		xerr = err
+		return
+	}
 	dataimage, _, err := req.FormFile("imagedata")
 	if err != nil {
 		xerr = ErrParam
 		return
 	}
-	imageout, err := self.saveImageToStorage(dataimage)
+	imageout, err := self.saveImageToStorage(dataimage, expires)
 	if err != nil {
 		xerr = err
 		return
@@ -218,11 +263,20 @@ func (self *HttpServer) handleImageUploadMore(res http.ResponseWriter, req *http
 	)
 	defer self.sendJsonData(res, req, &xerr, xdata)
 
+	if err := self.authorize(req, AuthWrite, self.config.ImageFilePath); err != nil {
+		xerr = err
+		return
+	}
 	if err := self.parseRequestBody(req); err != nil {
 		xerr = err
 		return
 	}
 
+	expires, err := parseTTL(req.FormValue("ttl"))
+	if err != nil {
+		xerr = err
+		return
+	}
 	for key, mfiles := range req.MultipartForm.File {
 		dataimage, err := mfiles[0].Open()
 		if err != nil {
@@ -231,7 +285,7 @@ func (self *HttpServer) handleImageUploadMore(res http.ResponseWriter, req *http
 			}
 			continue
 		}
-		imageout, err := self.saveImageToStorage(dataimage)
+		imageout, err := self.saveImageToStorage(dataimage, expires)
 		if err != nil {
 			xdata[key] = map[string]string{
 				"error": err.Error(),
@@ -0,0 +1,68 @@
+package tinynfs
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestImageGetReadOnly(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-image")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	srv := &HttpServer{
+		config: &Network{
+			ImageThumbnailSizes: map[string]bool{"1x1": true},
+		},
+		storage: fs,
+	}
+	if err := fs.WriteFile("/image/a", "image/png", "1x1", tinyPNG, nil); err != nil {
+		t.Fatal("WriteFile error", err)
+	}
+
+	fs.SetReadOnly(true)
+	res := httptest.NewRecorder()
+	srv.handleImageGet(res, httptest.NewRequest("GET", "/image/a_1x1", nil))
+	if res.Code != 200 || res.Body.Len() < 1 {
+		t.Error("Thumbnail error", res.Code, res.Body.String())
+	}
+	if _, err := fs.Stat("/image/a_1x1"); err != ErrNotExist {
+		t.Error("Thumbnail saved in read-only", err)
+	}
+
+	fs.SetReadOnly(false)
+	res = httptest.NewRecorder()
+	srv.handleImageGet(res, httptest.NewRequest("GET", "/image/a_1x1", nil))
+	if res.Code != 200 {
+		t.Error("Thumbnail error", res.Code, res.Body.String())
+	}
+	fnode, err := fs.Stat("/image/a_1x1")
+	if err != nil {
+		t.Fatal("Thumbnail not saved", err)
+	}
+	if etag := res.Header().Get("ETag"); etag != "\""+fnode.Hash+"\"" {
+		t.Error("Thumbnail ETag mismatch", etag)
+	}
+	if len(res.Header().Get("Last-Modified")) < 1 {
+		t.Error("Thumbnail Last-Modified missing")
+	} else {
+		t.Log("Image read-only success")
+	}
+}
@@ -0,0 +1,715 @@
+package tinynfs
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Namespace      = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3ISO8601Format  = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys        = 1000
+	s3MaxPartNumber  = 10000
+	s3MaxRequestBody = 1024 * 1024
+)
+
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (self *s3Error) Error() string {
+	return self.Message
+}
+
+var (
+	s3ErrAccessDenied                 = &s3Error{"AccessDenied", "Access Denied", http.StatusForbidden}
+	s3ErrAuthorizationHeaderMalformed = &s3Error{"AuthorizationHeaderMalformed", "The authorization header is malformed", http.StatusBadRequest}
+	s3ErrAuthorizationQueryMalformed  = &s3Error{"AuthorizationQueryParametersError", "The authorization query parameters are malformed", http.StatusBadRequest}
+	s3ErrBucketNotEmpty               = &s3Error{"BucketNotEmpty", "The bucket you tried to delete is not empty", http.StatusConflict}
+	s3ErrExpiredRequest               = &s3Error{"AccessDenied", "Request has expired", http.StatusForbidden}
+	s3ErrIncompleteBody               = &s3Error{"IncompleteBody", "The request body is incomplete", http.StatusBadRequest}
+	s3ErrInternalError                = &s3Error{"InternalError", "We encountered an internal error, please try again", http.StatusInternalServerError}
+	s3ErrInvalidAccessKeyId           = &s3Error{"InvalidAccessKeyId", "The access key Id you provided does not exist", http.StatusForbidden}
+	s3ErrInvalidArgument              = &s3Error{"InvalidArgument", "Invalid argument", http.StatusBadRequest}
+	s3ErrInvalidBucketName            = &s3Error{"InvalidBucketName", "The specified bucket is not valid", http.StatusBadRequest}
+	s3ErrInvalidPart                  = &s3Error{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+	s3ErrInvalidRequest               = &s3Error{"InvalidRequest", "Invalid request", http.StatusBadRequest}
+	s3ErrMalformedXML                 = &s3Error{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+	s3ErrMethodNotAllowed             = &s3Error{"MethodNotAllowed", "The specified method is not allowed against this resource", http.StatusMethodNotAllowed}
+	s3ErrNoSuchKey                    = &s3Error{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+	s3ErrNoSuchUpload                 = &s3Error{"NoSuchUpload", "The specified multipart upload does not exist", http.StatusNotFound}
+	s3ErrNotImplemented               = &s3Error{"NotImplemented", "A header you provided implies functionality that is not implemented", http.StatusNotImplemented}
+	s3ErrOperationAborted             = &s3Error{"OperationAborted", "A conflicting operation is currently in progress", http.StatusConflict}
+	s3ErrRequestTimeTooSkewed         = &s3Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large", http.StatusForbidden}
+	s3ErrServiceUnavailable           = &s3Error{"ServiceUnavailable", "The storage is read-only, please retry later", http.StatusServiceUnavailable}
+	s3ErrSignatureDoesNotMatch        = &s3Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided", http.StatusForbidden}
+	s3ErrXAmzContentSHA256Mismatch    = &s3Error{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed", http.StatusBadRequest}
+
+	s3BucketRegexp = regexp.MustCompile("^[a-zA-Z0-9][a-zA-Z0-9._-]{0,254}$")
+)
+
+func toS3Error(err error) *s3Error {
+	switch err {
+	case ErrParam:
+		return s3ErrInvalidArgument
+	case ErrPermission:
+		return s3ErrAccessDenied
+	case ErrNotExist:
+		return s3ErrNoSuchKey
+	case ErrUploadConflict:
+		return s3ErrOperationAborted
+	case ErrReadOnly:
+		return s3ErrServiceUnavailable
+	}
+	if e, ok := err.(*s3Error); ok {
+		return e
+	}
+	return &s3Error{s3ErrInternalError.Code, err.Error(), s3ErrInternalError.Status}
+}
+
+type s3ErrorResult struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+type s3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name `xml:"ListAllMyBucketsResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Owner   struct {
+		ID          string
+		DisplayName string
+	}
+	Buckets struct {
+		Bucket []*s3Bucket
+	}
+}
+
+type s3LocationConstraint struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	Marker                *string
+	NextMarker            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	KeyCount              *int
+	MaxKeys               int
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Contents              []*s3Object
+	CommonPrefixes        []*s3CommonPrefix
+}
+
+type s3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string
+	ETag         string
+}
+
+type s3Delete struct {
+	Quiet  bool
+	Object []struct {
+		Key string
+	}
+}
+
+type s3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type s3Deleted struct {
+	Key string
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Deleted []*s3Deleted
+	Error   []*s3DeleteError
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type s3CompleteMultipartUpload struct {
+	Part []struct {
+		PartNumber int
+		ETag       string
+	}
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+func s3ETag(hash string) string {
+	return "\"" + hash + "\""
+}
+
+func s3Time(unix int64) string {
+	return time.Unix(unix, 0).UTC().Format(s3ISO8601Format)
+}
+
+func s3EncodeKey(key string, encodingType string) string {
+	if encodingType == "url" {
+		return url.QueryEscape(key)
+	}
+	return key
+}
+
+func (self *HttpServer) startS3() {
+	server := &http.Server{
+		Handler: http.HandlerFunc(self.handleS3),
+	}
+	err := server.Serve(self.s3Listener)
+	if err != nil && !self.closed {
+		fmt.Println(err)
+	}
+}
+
+func (self *HttpServer) sendS3Data(res http.ResponseWriter, req *http.Request, err *error, status *int, data *interface{}) {
+	if *err != nil {
+		self.sendS3Error(res, req, *err)
+		return
+	}
+	if *data == nil {
+		res.WriteHeader(*status)
+		return
+	}
+	body, merr := xml.Marshal(*data)
+	if merr != nil {
+		self.sendS3Error(res, req, merr)
+		return
+	}
+	res.Header().Set("Content-Type", "application/xml")
+	res.WriteHeader(*status)
+	res.Write([]byte(xml.Header))
+	res.Write(body)
+}
+
+func (self *HttpServer) sendS3Error(res http.ResponseWriter, req *http.Request, err error) {
+	e := toS3Error(err)
+	body, _ := xml.Marshal(&s3ErrorResult{
+		Code:     e.Code,
+		Message:  e.Message,
+		Resource: req.URL.Path,
+	})
+	res.Header().Set("Content-Type", "application/xml")
+	res.WriteHeader(e.Status)
+	if req.Method != "HEAD" {
+		res.Write([]byte(xml.Header))
+		res.Write(body)
+	}
+}
+
+func (self *HttpServer) readS3Body(req *http.Request, signature *s3Signature, v interface{}) error {
+	body, err := ioutil.ReadAll(io.LimitReader(s3PayloadReader(req, signature), s3MaxRequestBody))
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(body, v); err != nil {
+		return s3ErrMalformedXML
+	}
+	return nil
+}
+
+// The bucket is the top level path, the key is the path in the bucket
+func (self *HttpServer) handleS3(res http.ResponseWriter, req *http.Request) {
+	signature, err := self.s3Authenticate(req)
+	if err != nil {
+		self.sendS3Error(res, req, err)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/")
+	if len(path) < 1 {
+		if req.Method != "GET" {
+			self.sendS3Error(res, req, s3ErrMethodNotAllowed)
+			return
+		}
+		self.handleS3ListBuckets(res, req)
+		return
+	}
+	fields := strings.SplitN(path, "/", 2)
+	bucket := fields[0]
+	if !s3BucketRegexp.MatchString(bucket) || bucket == "." || bucket == ".." {
+		self.sendS3Error(res, req, s3ErrInvalidBucketName)
+		return
+	}
+	if len(fields) < 2 || len(fields[1]) < 1 {
+		self.handleS3Bucket(res, req, signature, bucket)
+		return
+	}
+	key := fields[1]
+	if strings.HasSuffix(key, "/") {
+		self.sendS3Error(res, req, s3ErrInvalidArgument)
+		return
+	}
+	self.handleS3Object(res, req, signature, bucket, key)
+}
+
+func (self *HttpServer) handleS3ListBuckets(res http.ResponseWriter, req *http.Request) {
+	var (
+		xerr    error
+		xstatus = http.StatusOK
+		xdata   interface{}
+	)
+	defer self.sendS3Data(res, req, &xerr, &xstatus, &xdata)
+
+	result := &s3ListAllMyBucketsResult{
+		Xmlns: s3Namespace,
+	}
+	result.Owner.ID = "tinynfs"
+	result.Owner.DisplayName = "tinynfs"
+	result.Buckets.Bucket = []*s3Bucket{}
+	// The bucket is a path prefix without creation time, the server started
+	// time is used
+	cursor := ""
+	for {
+		list, err := self.storage.List("/", "/", cursor, 0)
+		if err != nil {
+			xerr = err
+			return
+		}
+		for _, v := range list.Prefixes {
+			result.Buckets.Bucket = append(result.Buckets.Bucket, &s3Bucket{
+				Name:         strings.Trim(v, "/"),
+				CreationDate: s3Time(self.started),
+			})
+		}
+		if cursor = list.Cursor; len(cursor) < 1 {
+			break
+		}
+	}
+	xdata = result
+}
+
+func (self *HttpServer) handleS3Bucket(res http.ResponseWriter, req *http.Request, signature *s3Signature, bucket string) {
+	var (
+		xerr    error
+		xstatus = http.StatusOK
+		xdata   interface{}
+	)
+	defer self.sendS3Data(res, req, &xerr, &xstatus, &xdata)
+
+	query := req.URL.Query()
+	switch req.Method {
+	case "HEAD":
+		// The bucket always exists, it is the path prefix only
+	case "PUT":
+		res.Header().Set("Location", "/"+bucket)
+	case "DELETE":
+		list, err := self.storage.List("/"+bucket+"/", "", "", 1)
+		if err != nil {
+			xerr = err
+			return
+		}
+		if len(list.Files) > 0 {
+			xerr = s3ErrBucketNotEmpty
+			return
+		}
+		xstatus = http.StatusNoContent
+	case "GET":
+		if _, ok := query["location"]; ok {
+			xdata = &s3LocationConstraint{
+				Xmlns:    s3Namespace,
+				Location: self.config.S3Region,
+			}
+			return
+		}
+		if _, ok := query["uploads"]; ok {
+			xerr = s3ErrNotImplemented
+			return
+		}
+		result, err := self.listS3Objects(bucket, query)
+		if err != nil {
+			xerr = err
+			return
+		}
+		xdata = result
+	case "POST":
+		if _, ok := query["delete"]; !ok {
+			xerr = s3ErrNotImplemented
+			return
+		}
+		result, err := self.deleteS3Objects(req, signature, bucket)
+		if err != nil {
+			xerr = err
+			return
+		}
+		xdata = result
+	default:
+		xerr = s3ErrMethodNotAllowed
+	}
+}
+
+func (self *HttpServer) listS3Objects(bucket string, query url.Values) (*s3ListBucketResult, error) {
+	var (
+		v2           = query.Get("list-type") == "2"
+		prefix       = query.Get("prefix")
+		delimiter    = query.Get("delimiter")
+		encodingType = query.Get("encoding-type")
+		root         = "/" + bucket + "/"
+		maxKeys      = s3MaxKeys
+	)
+	if v := query.Get("max-keys"); len(v) > 0 {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, s3ErrInvalidArgument
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	result := &s3ListBucketResult{
+		Xmlns:          s3Namespace,
+		Name:           bucket,
+		Prefix:         s3EncodeKey(prefix, encodingType),
+		Delimiter:      s3EncodeKey(delimiter, encodingType),
+		MaxKeys:        maxKeys,
+		EncodingType:   encodingType,
+		Contents:       []*s3Object{},
+		CommonPrefixes: []*s3CommonPrefix{},
+	}
+	after := query.Get("marker")
+	if v2 {
+		result.ContinuationToken = query.Get("continuation-token")
+		result.StartAfter = s3EncodeKey(query.Get("start-after"), encodingType)
+		after = query.Get("start-after")
+	} else {
+		result.Marker = &after
+	}
+
+	cursor := ""
+	if v2 && len(result.ContinuationToken) > 0 {
+		cursor = result.ContinuationToken
+	} else if len(after) > 0 {
+		// Continue after the key, or after all keys of the common prefix
+		start := []byte(root + after + "\x00")
+		if len(delimiter) > 0 && strings.HasSuffix(after, delimiter) {
+			start = prefixUpperBound([]byte(root + after))
+		}
+		if string(start) < root+prefix {
+			start = nil
+		} else if !strings.HasPrefix(string(start), root+prefix) {
+			maxKeys = 0
+		}
+		if len(start) > 0 {
+			cursor = encodeListCursor(start)
+		}
+	}
+
+	count := 0
+	if maxKeys > 0 {
+		list, err := self.storage.List(root+prefix, delimiter, cursor, maxKeys)
+		if err != nil {
+			return nil, err
+		}
+		last := ""
+		for _, v := range list.Files {
+			key := strings.TrimPrefix(v.FilePath, root)
+			result.Contents = append(result.Contents, &s3Object{
+				Key:          s3EncodeKey(key, encodingType),
+				LastModified: s3Time(v.Created),
+				ETag:         s3ETag(v.Hash),
+				Size:         v.Size,
+				StorageClass: "STANDARD",
+			})
+			if key > last {
+				last = key
+			}
+		}
+		for _, v := range list.Prefixes {
+			key := strings.TrimPrefix(v, root)
+			result.CommonPrefixes = append(result.CommonPrefixes, &s3CommonPrefix{
+				Prefix: s3EncodeKey(key, encodingType),
+			})
+			if key > last {
+				last = key
+			}
+		}
+		count = len(list.Files) + len(list.Prefixes)
+		if len(list.Cursor) > 0 {
+			result.IsTruncated = true
+			if v2 {
+				result.NextContinuationToken = list.Cursor
+			} else {
+				result.NextMarker = s3EncodeKey(last, encodingType)
+			}
+		}
+	}
+	if v2 {
+		result.KeyCount = &count
+	}
+	return result, nil
+}
+
+func (self *HttpServer) deleteS3Objects(req *http.Request, signature *s3Signature, bucket string) (*s3DeleteResult, error) {
+	var body s3Delete
+	if err := self.readS3Body(req, signature, &body); err != nil {
+		return nil, err
+	}
+	result := &s3DeleteResult{
+		Xmlns:   s3Namespace,
+		Deleted: []*s3Deleted{},
+		Error:   []*s3DeleteError{},
+	}
+	for _, v := range body.Object {
+		err := self.storage.DeleteFile("/" + bucket + "/" + v.Key)
+		if err != nil && err != ErrNotExist {
+			e := toS3Error(err)
+			result.Error = append(result.Error, &s3DeleteError{v.Key, e.Code, e.Message})
+		} else if !body.Quiet {
+			result.Deleted = append(result.Deleted, &s3Deleted{v.Key})
+		}
+	}
+	return result, nil
+}
+
+func (self *HttpServer) handleS3Object(res http.ResponseWriter, req *http.Request, signature *s3Signature, bucket string, key string) {
+	var (
+		query    = req.URL.Query()
+		filepath = "/" + bucket + "/" + key
+	)
+	if uploadId := query.Get("uploadId"); len(uploadId) > 0 {
+		self.handleS3Multipart(res, req, signature, bucket, key, uploadId)
+		return
+	}
+
+	switch req.Method {
+	case "GET", "HEAD":
+		var (
+			file *FileReader
+			err  error
+		)
+		if req.Method == "HEAD" {
+			fnode, serr := self.storage.Stat(filepath)
+			if serr == nil {
+				file = newHeadFileReader(fnode)
+			}
+			err = serr
+		} else {
+			file, err = self.storage.OpenFile(filepath)
+		}
+		if err != nil {
+			self.sendS3Error(res, req, err)
+			return
+		}
+		defer file.Close()
+		header := res.Header()
+		if len(file.Node.Mime) > 0 {
+			header.Set("Content-Type", file.Node.Mime)
+		} else {
+			header.Set("Content-Type", "application/octet-stream")
+		}
+		header.Set("ETag", s3ETag(file.Node.Hash))
+		http.ServeContent(res, req, "", time.Unix(file.Node.Created, 0), file)
+		return
+	}
+
+	var (
+		xerr    error
+		xstatus = http.StatusOK
+		xdata   interface{}
+	)
+	defer self.sendS3Data(res, req, &xerr, &xstatus, &xdata)
+
+	switch req.Method {
+	case "PUT":
+		if source := req.Header.Get("X-Amz-Copy-Source"); len(source) > 0 {
+			result, err := self.copyS3Object(source, filepath)
+			if err != nil {
+				xerr = err
+				return
+			}
+			xdata = result
+			return
+		}
+		if _, err := self.storage.WriteStream(filepath, req.Header.Get("Content-Type"), "", s3PayloadReader(req, signature), nil); err != nil {
+			xerr = err
+			return
+		}
+		fnode, err := self.storage.Stat(filepath)
+		if err != nil {
+			xerr = err
+			return
+		}
+		res.Header().Set("ETag", s3ETag(fnode.Hash))
+	case "DELETE":
+		if err := self.storage.DeleteFile(filepath); err != nil && err != ErrNotExist {
+			xerr = err
+			return
+		}
+		xstatus = http.StatusNoContent
+	case "POST":
+		if _, ok := query["uploads"]; !ok {
+			xerr = s3ErrNotImplemented
+			return
+		}
+		session, err := self.storage.CreateUploadParts(filepath, req.Header.Get("Content-Type"), "", nil)
+		if err != nil {
+			xerr = err
+			return
+		}
+		xdata = &s3InitiateMultipartUploadResult{
+			Xmlns:    s3Namespace,
+			Bucket:   bucket,
+			Key:      key,
+			UploadId: session.Id,
+		}
+	default:
+		xerr = s3ErrMethodNotAllowed
+	}
+}
+
+func (self *HttpServer) copyS3Object(source string, filepath string) (*s3CopyObjectResult, error) {
+	source, err := url.PathUnescape(strings.SplitN(source, "?", 2)[0])
+	if err != nil {
+		return nil, s3ErrInvalidArgument
+	}
+	fields := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+	if len(fields) != 2 || !s3BucketRegexp.MatchString(fields[0]) || len(fields[1]) < 1 {
+		return nil, s3ErrInvalidArgument
+	}
+	srcpath := "/" + fields[0] + "/" + fields[1]
+	if srcpath == filepath {
+		return nil, s3ErrInvalidRequest
+	}
+	if err := self.storage.Copy(srcpath, filepath, true); err != nil {
+		return nil, err
+	}
+	fnode, err := self.storage.Stat(filepath)
+	if err != nil {
+		return nil, err
+	}
+	return &s3CopyObjectResult{
+		Xmlns:        s3Namespace,
+		LastModified: s3Time(fnode.Created),
+		ETag:         s3ETag(fnode.Hash),
+	}, nil
+}
+
+func (self *HttpServer) handleS3Multipart(res http.ResponseWriter, req *http.Request, signature *s3Signature, bucket string, key string, uploadId string) {
+	var (
+		xerr    error
+		xstatus = http.StatusOK
+		xdata   interface{}
+	)
+	defer self.sendS3Data(res, req, &xerr, &xstatus, &xdata)
+
+	session, err := self.storage.StatUpload(uploadId)
+	if err != nil || session.FilePath != "/"+bucket+"/"+key {
+		xerr = s3ErrNoSuchUpload
+		return
+	}
+
+	switch req.Method {
+	case "PUT":
+		if len(req.Header.Get("X-Amz-Copy-Source")) > 0 {
+			xerr = s3ErrNotImplemented
+			return
+		}
+		number, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+		if err != nil || number < 1 || number > s3MaxPartNumber {
+			xerr = s3ErrInvalidArgument
+			return
+		}
+		part, err := self.storage.WriteUploadPart(uploadId, number, s3PayloadReader(req, signature))
+		if err != nil {
+			xerr = err
+			return
+		}
+		res.Header().Set("ETag", s3ETag(part.Hash))
+	case "POST":
+		var body s3CompleteMultipartUpload
+		if err := self.readS3Body(req, signature, &body); err != nil {
+			xerr = err
+			return
+		}
+		parts := []*UploadPart{}
+		for _, v := range body.Part {
+			parts = append(parts, &UploadPart{
+				Number: v.PartNumber,
+				Hash:   strings.Trim(v.ETag, "\""),
+			})
+		}
+		if _, err := self.storage.CommitUploadParts(uploadId, parts); err != nil {
+			if err == ErrParam {
+				err = s3ErrInvalidPart
+			}
+			xerr = err
+			return
+		}
+		fnode, err := self.storage.Stat(session.FilePath)
+		if err != nil {
+			xerr = err
+			return
+		}
+		xdata = &s3CompleteMultipartUploadResult{
+			Xmlns:    s3Namespace,
+			Location: "/" + bucket + "/" + key,
+			Bucket:   bucket,
+			Key:      key,
+			ETag:     s3ETag(fnode.Hash),
+		}
+	case "DELETE":
+		if err := self.storage.AbortUpload(uploadId); err != nil {
+			xerr = err
+			return
+		}
+		xstatus = http.StatusNoContent
+	default:
+		xerr = s3ErrNotImplemented
+	}
+}
@@ -0,0 +1,258 @@
+package tinynfs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type s3TestClient struct {
+	t   *testing.T
+	srv *HttpServer
+}
+
+// The request signed by SigV4, the payload is the hash of body when empty
+func (self *s3TestClient) sign(req *http.Request, payload string) (string, string, string, []byte) {
+	now := time.Now().UTC()
+	timestamp := now.Format(s3TimeFormat)
+	date := now.Format("20060102")
+	scope := date + "/us-east-1/s3/aws4_request"
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	signingKey := s3SigningKey("tester-secret", date, "us-east-1")
+	canonical := s3CanonicalRequest(req, headers, payload)
+	signature := hex.EncodeToString(s3HmacSHA256(signingKey, s3StringToSign(timestamp, scope, canonical)))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=tester/%s,SignedHeaders=%s,Signature=%s",
+		s3Algorithm, scope, strings.Join(headers, ";"), signature))
+	return signature, timestamp, scope, signingKey
+}
+
+func (self *s3TestClient) do(method string, uri string, body []byte, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://127.0.0.1"+uri, bytes.NewReader(body))
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	self.sign(req, s3SHA256Hex(body))
+	res := httptest.NewRecorder()
+	self.srv.handleS3(res, req)
+	return res
+}
+
+// The aws-chunked body, every chunk is signed by the previous signature
+func (self *s3TestClient) doChunked(uri string, chunks [][]byte, broken bool) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("PUT", "http://127.0.0.1"+uri, nil)
+	previous, timestamp, scope, signingKey := self.sign(req, s3StreamingPayload)
+	var body bytes.Buffer
+	for _, chunk := range append(chunks, []byte{}) {
+		toSign := strings.Join([]string{
+			"AWS4-HMAC-SHA256-PAYLOAD",
+			timestamp,
+			scope,
+			previous,
+			s3EmptyHash,
+			s3SHA256Hex(chunk),
+		}, "\n")
+		previous = hex.EncodeToString(s3HmacSHA256(signingKey, toSign))
+		if broken {
+			chunk = bytes.ToUpper(chunk)
+		}
+		fmt.Fprintf(&body, "%x;chunk-signature=%s\r\n", len(chunk), previous)
+		if len(chunk) > 0 {
+			body.Write(chunk)
+			body.WriteString("\r\n")
+		}
+	}
+	body.WriteString("\r\n")
+	req.Body = ioutil.NopCloser(&body)
+	res := httptest.NewRecorder()
+	self.srv.handleS3(res, req)
+	return res
+}
+
+func (self *s3TestClient) expect(res *httptest.ResponseRecorder, status int, name string) {
+	if res.Code != status {
+		self.t.Error(name, res.Code, res.Body.String())
+	}
+}
+
+func (self *s3TestClient) decode(res *httptest.ResponseRecorder, v interface{}) {
+	if err := xml.Unmarshal(res.Body.Bytes(), v); err != nil {
+		self.t.Error("Decode error", err, res.Body.String())
+	}
+}
+
+func (self *s3TestClient) list(query string) *s3ListBucketResult {
+	res := self.do("GET", "/bucket?"+query, nil, nil)
+	self.expect(res, 200, "ListObjects error")
+	result := &s3ListBucketResult{}
+	self.decode(res, result)
+	return result
+}
+
+func TestS3Gateway(t *testing.T) {
+	root := filepath.Join("../../test", "data-fs-s3")
+	os.RemoveAll(root)
+	fs, err := NewFileSystem(root, &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	srv := &HttpServer{
+		started: time.Now().Unix(),
+		config: &Network{
+			S3Region:      "us-east-1",
+			S3Credentials: map[string]string{"tester": "tester-secret"},
+		},
+		storage: fs,
+	}
+	c := &s3TestClient{t, srv}
+
+	res := httptest.NewRecorder()
+	srv.handleS3(res, httptest.NewRequest("GET", "http://127.0.0.1/bucket/a.txt", nil))
+	c.expect(res, 403, "Anonymous allowed")
+
+	// Bucket and objects
+	c.expect(c.do("PUT", "/bucket", nil, nil), 200, "CreateBucket error")
+	for _, key := range []string{"a.txt", "d.txt", "dir/b.txt", "dir/c.txt"} {
+		res := c.do("PUT", "/bucket/"+key, fsTestBuffer, map[string]string{"Content-Type": "text/plain"})
+		c.expect(res, 200, "PutObject error")
+		if fnode, err := fs.Stat("/bucket/" + key); err != nil || res.Header().Get("ETag") != s3ETag(fnode.Hash) {
+			t.Error("PutObject ETag mismatch", res.Header().Get("ETag"), err)
+		}
+	}
+	res = c.do("GET", "/bucket/a.txt", nil, nil)
+	c.expect(res, 200, "GetObject error")
+	if !bytes.Equal(res.Body.Bytes(), fsTestBuffer) || res.Header().Get("Content-Type") != "text/plain" {
+		t.Error("GetObject mismatch", res.Body.String())
+	}
+	res = c.do("HEAD", "/bucket/a.txt", nil, nil)
+	c.expect(res, 200, "HeadObject error")
+	if res.Header().Get("Content-Length") != fmt.Sprint(len(fsTestBuffer)) || res.Body.Len() > 0 {
+		t.Error("HeadObject mismatch", res.Header())
+	}
+	c.expect(c.do("GET", "/bucket/none.txt", nil, nil), 404, "GetObject not exists")
+
+	res = c.do("GET", "/", nil, nil)
+	c.expect(res, 200, "ListBuckets error")
+	buckets := &s3ListAllMyBucketsResult{}
+	c.decode(res, buckets)
+	if len(buckets.Buckets.Bucket) != 1 || buckets.Buckets.Bucket[0].Name != "bucket" || buckets.Buckets.Bucket[0].CreationDate != s3Time(srv.started) {
+		t.Error("ListBuckets mismatch", res.Body.String())
+	}
+
+	// ListObjectsV2 by pages
+	keys := []string{}
+	token := ""
+	for i := 0; i < 3; i++ {
+		query := "list-type=2&max-keys=3"
+		if len(token) > 0 {
+			query += "&continuation-token=" + url.QueryEscape(token)
+		}
+		result := c.list(query)
+		for _, v := range result.Contents {
+			keys = append(keys, v.Key)
+		}
+		if token = result.NextContinuationToken; !result.IsTruncated {
+			break
+		}
+	}
+	if strings.Join(keys, ",") != "a.txt,d.txt,dir/b.txt,dir/c.txt" {
+		t.Error("ListObjectsV2 pages mismatch", keys)
+	}
+	result := c.list("list-type=2&delimiter=/")
+	if len(result.Contents) != 2 || len(result.CommonPrefixes) != 1 || result.CommonPrefixes[0].Prefix != "dir/" || *result.KeyCount != 3 {
+		t.Error("ListObjectsV2 delimiter mismatch", result)
+	}
+	result = c.list("list-type=2&prefix=dir/&start-after=dir/b.txt")
+	if len(result.Contents) != 1 || result.Contents[0].Key != "dir/c.txt" {
+		t.Error("ListObjectsV2 start-after mismatch", result)
+	}
+
+	// CopyObject, DeleteObject and DeleteObjects
+	res = c.do("PUT", "/bucket/e.txt", nil, map[string]string{"X-Amz-Copy-Source": "/bucket/a.txt"})
+	c.expect(res, 200, "CopyObject error")
+	copied := &s3CopyObjectResult{}
+	c.decode(res, copied)
+	if fnode, err := fs.Stat("/bucket/a.txt"); err != nil || copied.ETag != s3ETag(fnode.Hash) {
+		t.Error("CopyObject mismatch", res.Body.String())
+	}
+	c.expect(c.do("DELETE", "/bucket/e.txt", nil, nil), 204, "DeleteObject error")
+	if _, err := fs.Stat("/bucket/e.txt"); err != ErrNotExist {
+		t.Error("DeleteObject exists", err)
+	}
+	res = c.do("POST", "/bucket?delete", []byte("<Delete><Object><Key>d.txt</Key></Object><Object><Key>dir/b.txt</Key></Object></Delete>"), nil)
+	c.expect(res, 200, "DeleteObjects error")
+	deleted := &s3DeleteResult{}
+	c.decode(res, deleted)
+	if len(deleted.Deleted) != 2 || len(deleted.Error) != 0 {
+		t.Error("DeleteObjects mismatch", res.Body.String())
+	}
+	for _, name := range []string{"/bucket/d.txt", "/bucket/dir/b.txt"} {
+		if _, err := fs.Stat(name); err != ErrNotExist {
+			t.Error("DeleteObjects exists", name, err)
+		}
+	}
+	c.expect(c.do("DELETE", "/bucket", nil, nil), 409, "DeleteBucket not empty")
+
+	// Multipart upload
+	res = c.do("POST", "/bucket/m.bin?uploads", nil, nil)
+	c.expect(res, 200, "CreateMultipartUpload error")
+	initiated := &s3InitiateMultipartUploadResult{}
+	c.decode(res, initiated)
+	parts := [][]byte{bytes.Repeat([]byte("a"), 1024), bytes.Repeat([]byte("b"), 100)}
+	complete := "<CompleteMultipartUpload>"
+	for i, v := range parts {
+		res := c.do("PUT", fmt.Sprintf("/bucket/m.bin?partNumber=%d&uploadId=%s", i+1, initiated.UploadId), v, nil)
+		c.expect(res, 200, "UploadPart error")
+		complete += fmt.Sprintf("<Part><PartNumber>%d</PartNumber><ETag>%s</ETag></Part>", i+1, res.Header().Get("ETag"))
+	}
+	complete += "</CompleteMultipartUpload>"
+	res = c.do("POST", "/bucket/m.bin?uploadId="+initiated.UploadId, []byte(complete), nil)
+	c.expect(res, 200, "CompleteMultipartUpload error")
+	if _, _, data, err := fs.ReadFile("/bucket/m.bin"); err != nil || !bytes.Equal(data, bytes.Join(parts, nil)) {
+		t.Error("CompleteMultipartUpload mismatch", err)
+	}
+	res = c.do("POST", "/bucket/n.bin?uploads", nil, nil)
+	c.decode(res, initiated)
+	c.expect(c.do("PUT", "/bucket/n.bin?partNumber=1&uploadId="+initiated.UploadId, parts[0], nil), 200, "UploadPart error")
+	c.expect(c.do("DELETE", "/bucket/n.bin?uploadId="+initiated.UploadId, nil, nil), 204, "AbortMultipartUpload error")
+	if _, err := fs.StatUpload(initiated.UploadId); err != ErrNotExist {
+		t.Error("AbortMultipartUpload exists", err)
+	}
+
+	// The aws-chunked body
+	chunks := [][]byte{[]byte("hello "), []byte("chunked")}
+	c.expect(c.doChunked("/bucket/chunked.txt", chunks, false), 200, "PutObject chunked error")
+	if _, _, data, err := fs.ReadFile("/bucket/chunked.txt"); err != nil || string(data) != "hello chunked" {
+		t.Error("PutObject chunked mismatch", err, string(data))
+	}
+	c.expect(c.doChunked("/bucket/broken.txt", chunks, true), 403, "PutObject broken chunk")
+	if _, err := fs.Stat("/bucket/broken.txt"); err != ErrNotExist {
+		t.Error("PutObject broken chunk saved", err)
+	} else {
+		t.Log("S3 gateway success")
+	}
+}
@@ -0,0 +1,45 @@
+package tinynfs
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseMeta(t *testing.T) {
+	req := httptest.NewRequest("POST", "/upload?filepath=/files/a", nil)
+	req.Header.Set("X-Meta-Original-Filename", "a.txt")
+	req.Form = url.Values{"meta-Tags": []string{"x,y"}, "filepath": []string{"/files/a"}}
+	meta, err := parseMeta(req)
+	if err != nil {
+		t.Fatal("Parse meta error", err)
+	}
+	if len(meta) != 2 || meta["original-filename"] != "a.txt" || meta["tags"] != "x,y" {
+		t.Errorf("Meta mismatch: %v", meta)
+	}
+
+	req.Header.Set("X-Meta-Bad", "a\r\nb")
+	if _, err := parseMeta(req); err != ErrParam {
+		t.Error("Bad value allowed", err)
+	}
+	req.Header.Del("X-Meta-Bad")
+	req.Header.Set("X-Meta-Large", strings.Repeat("a", metaMaxSize))
+	if _, err := parseMeta(req); err != ErrParam {
+		t.Error("Large meta allowed", err)
+	} else {
+		t.Log("Parse meta success")
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	if v := contentDisposition("inline", "a \"b\".txt"); v != "inline; filename=\"a _b_.txt\"" {
+		t.Error("ASCII mismatch: " + v)
+	}
+	v := contentDisposition("attachment", "报告 1.pdf")
+	if v != "attachment; filename=\"______ 1.pdf\"; filename*=UTF-8''%E6%8A%A5%E5%91%8A%201.pdf" {
+		t.Error("UTF-8 mismatch: " + v)
+	} else {
+		t.Log("Content disposition success: " + v)
+	}
+}
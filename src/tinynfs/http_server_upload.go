@@ -0,0 +1,212 @@
+package tinynfs
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+func setUploadSessionData(xdata map[string]interface{}, session *UploadSession) {
+	xdata["id"] = session.Id
+	xdata["filepath"] = session.FilePath
+	xdata["mime"] = session.Mime
+	xdata["size"] = session.Size
+	xdata["offset"] = session.Offset
+	xdata["expires"] = session.Expires
+}
+
+// The upload session is authorized by its file path, the presigned url of
+// creating is accepted too.
+func (self *HttpServer) authorizeUpload(req *http.Request, id string) error {
+	if len(self.config.AuthKeys) < 1 && len(self.config.AuthPrivates) < 1 {
+		return nil
+	}
+	session, err := self.storage.StatUpload(id)
+	if err != nil {
+		return err
+	}
+	method := "POST"
+	if session.Overwrite {
+		method = "PUT"
+	}
+	return self.authorizeMethod(req, method, AuthWrite, session.FilePath)
+}
+
+func (self *HttpServer) handleUploadCreate(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && req.Method != "PUT" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.parseRequestBody(req); err != nil {
+		xerr = err
+		return
+	}
+
+	filepath := req.FormValue("filepath")
+	if !strings.HasPrefix(filepath, "/") || strings.HasSuffix(filepath, "/") {
+		xerr = ErrParam
+		return
+	}
+	if err := self.authorize(req, AuthWrite, filepath); err != nil {
+		xerr = err
+		return
+	}
+	size := int64(-1)
+	if v := req.FormValue("size"); len(v) > 0 {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			xerr = ErrParam
+			return
+		}
+		size = n
+	}
+	expires, err := parseTTL(req.FormValue("ttl"))
+	if err != nil {
+		xerr = err
+		return
+	}
+	meta, err := parseMeta(req)
+	if err != nil {
+		xerr = err
+		return
+	}
+	options := &WriteOptions{
+		Overwrite: req.Method == "PUT",
+		Expires:   expires,
+		Meta:      meta,
+		Filename:  req.FormValue("filename"),
+	}
+
+	session, err := self.storage.CreateUpload(filepath, req.FormValue("mime"), "", size, options)
+	if err != nil {
+		xerr = err
+		return
+	}
+	setUploadSessionData(xdata, session)
+}
+
+func (self *HttpServer) handleUploadChunk(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" && req.Method != "PATCH" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	// The request body is chunk data
+	query := req.URL.Query()
+	offset, err := strconv.ParseInt(query.Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		xerr = ErrParam
+		return
+	}
+
+	if err := self.authorizeUpload(req, query.Get("id")); err != nil {
+		xerr = err
+		return
+	}
+
+	session, err := self.storage.WriteUpload(query.Get("id"), offset, req.Body)
+	if err != nil {
+		xerr = err
+		return
+	}
+	setUploadSessionData(xdata, session)
+}
+
+func (self *HttpServer) handleUploadStatus(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.authorizeUpload(req, req.FormValue("id")); err != nil {
+		xerr = err
+		return
+	}
+
+	session, err := self.storage.StatUpload(req.FormValue("id"))
+	if err != nil {
+		xerr = err
+		return
+	}
+	setUploadSessionData(xdata, session)
+}
+
+func (self *HttpServer) handleUploadCommit(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.parseRequestBody(req); err != nil {
+		xerr = err
+		return
+	}
+
+	if err := self.authorizeUpload(req, req.FormValue("id")); err != nil {
+		xerr = err
+		return
+	}
+
+	session, err := self.storage.CommitUpload(req.FormValue("id"))
+	if err != nil {
+		xerr = err
+		return
+	}
+	xdata["size"] = session.Offset
+	xdata["mime"] = session.Mime
+	xdata["filepath"] = session.FilePath
+}
+
+func (self *HttpServer) handleUploadAbort(res http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(res, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var (
+		xerr  error
+		xdata = map[string]interface{}{}
+	)
+	defer self.sendJsonData(res, req, &xerr, xdata)
+
+	if err := self.parseRequestBody(req); err != nil {
+		xerr = err
+		return
+	}
+
+	id := req.FormValue("id")
+	if err := self.authorizeUpload(req, id); err != nil {
+		xerr = err
+		return
+	}
+	if err := self.storage.AbortUpload(id); err != nil {
+		xerr = err
+		return
+	}
+	xdata["id"] = id
+}
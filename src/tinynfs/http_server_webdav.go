@@ -0,0 +1,518 @@
+package tinynfs
+
+import (
+	"context"
+	"fmt"
+	"golang.org/x/net/webdav"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The key of request content length in the context of webdav handler
+type davLengthKey struct{}
+
+type davBodyKey struct{}
+
+type davAllowKey struct{}
+
+type davFileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	node    *FileNode
+}
+
+func (self *davFileInfo) Name() string {
+	return path.Base(self.name)
+}
+
+func (self *davFileInfo) Size() int64 {
+	return self.size
+}
+
+func (self *davFileInfo) Mode() os.FileMode {
+	if self.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (self *davFileInfo) ModTime() time.Time {
+	return self.modTime
+}
+
+func (self *davFileInfo) IsDir() bool {
+	return self.node == nil
+}
+
+func (self *davFileInfo) Sys() interface{} {
+	return nil
+}
+
+// The properties from the file node, the volume is not read
+func (self *davFileInfo) ContentType(ctx context.Context) (string, error) {
+	if self.node == nil || len(self.node.Mime) < 1 {
+		return "application/octet-stream", nil
+	}
+	return self.node.Mime, nil
+}
+
+func (self *davFileInfo) ETag(ctx context.Context) (string, error) {
+	if self.node == nil || len(self.node.Hash) < 1 {
+		return "", webdav.ErrNotImplemented
+	}
+	return "\"" + self.node.Hash + "\"", nil
+}
+
+func newDavFileInfo(name string, fnode *FileNode) *davFileInfo {
+	if fnode == nil {
+		return &davFileInfo{name: name, modTime: time.Now()}
+	}
+	return &davFileInfo{name, int64(fnode.Size), time.Unix(fnode.Created, 0), fnode}
+}
+
+type davFile struct {
+	*FileReader
+	info *davFileInfo
+}
+
+func (self *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (self *davFile) Stat() (os.FileInfo, error) {
+	return self.info, nil
+}
+
+func (self *davFile) Write(p []byte) (int, error) {
+	return 0, os.ErrPermission
+}
+
+type davDir struct {
+	fs    *davFileSystem
+	name  string
+	allow func(string) bool
+	infos []os.FileInfo
+	read  bool
+}
+
+func (self *davDir) Close() error {
+	return nil
+}
+
+func (self *davDir) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (self *davDir) Seek(offset int64, whence int) (int64, error) {
+	return 0, nil
+}
+
+func (self *davDir) Write(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (self *davDir) Stat() (os.FileInfo, error) {
+	return newDavFileInfo(self.name, nil), nil
+}
+
+func (self *davDir) Readdir(count int) ([]os.FileInfo, error) {
+	if !self.read {
+		infos, err := self.fs.readDir(self.name)
+		if err != nil {
+			return nil, err
+		}
+		// The private entries are hidden from the request without the key
+		if self.allow != nil {
+			allowed := []os.FileInfo{}
+			for _, v := range infos {
+				if self.allow(v.(*davFileInfo).name) {
+					allowed = append(allowed, v)
+				}
+			}
+			infos = allowed
+		}
+		self.infos = infos
+		self.read = true
+	}
+	if count <= 0 {
+		infos := self.infos
+		self.infos = nil
+		return infos, nil
+	}
+	if len(self.infos) < 1 {
+		return nil, io.EOF
+	}
+	if count > len(self.infos) {
+		count = len(self.infos)
+	}
+	infos := self.infos[:count]
+	self.infos = self.infos[count:]
+	return infos, nil
+}
+
+// The file data is streamed to storage, it is written when closing. The
+// webdav handler closes the file even if the request body was broken, the
+// incomplete data must not be written.
+type davWriter struct {
+	name   string
+	size   int64
+	length int64
+	body   *authHashReader
+	err    error
+	writer *io.PipeWriter
+	done   chan error
+}
+
+func (self *davWriter) Close() error {
+	if self.err == nil && self.length >= 0 && self.size != self.length {
+		self.err = io.ErrUnexpectedEOF
+	}
+	if self.err == nil && self.body != nil && self.body.err != nil {
+		self.err = self.body.err
+	}
+	if self.err != nil {
+		self.writer.CloseWithError(self.err)
+		<-self.done
+		return self.err
+	}
+	self.writer.Close()
+	return <-self.done
+}
+
+func (self *davWriter) Read(p []byte) (int, error) {
+	return 0, os.ErrInvalid
+}
+
+func (self *davWriter) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence == io.SeekStart || whence == io.SeekEnd) && self.size == 0 {
+		return 0, nil
+	}
+	return 0, os.ErrInvalid
+}
+
+func (self *davWriter) Write(p []byte) (int, error) {
+	n, err := self.writer.Write(p)
+	self.size += int64(n)
+	if err != nil && self.err == nil {
+		self.err = err
+	}
+	return n, err
+}
+
+func (self *davWriter) Readdir(count int) ([]os.FileInfo, error) {
+	return nil, os.ErrInvalid
+}
+
+func (self *davWriter) Stat() (os.FileInfo, error) {
+	return &davFileInfo{self.name, self.size, time.Now(), &FileNode{}}, nil
+}
+
+// The directories are the prefixes of file paths, the empty directories
+// created by MKCOL are kept in memory only.
+type davFileSystem struct {
+	storage *FileSystem
+	dirs    map[string]bool
+	dirLock sync.Mutex
+}
+
+// The name may end with slash, e.g. "/dir/" of MKCOL
+func davCleanName(name string) string {
+	return path.Clean("/" + name)
+}
+
+func (self *davFileSystem) hasDir(name string) (bool, error) {
+	if name == "/" {
+		return true, nil
+	}
+	self.dirLock.Lock()
+	ok := self.dirs[name]
+	self.dirLock.Unlock()
+	if ok {
+		return true, nil
+	}
+	list, err := self.storage.List(name+"/", "", "", 1)
+	if err != nil {
+		return false, err
+	}
+	return len(list.Files) > 0, nil
+}
+
+func (self *davFileSystem) readDir(name string) ([]os.FileInfo, error) {
+	prefix := strings.TrimSuffix(name, "/") + "/"
+	infos := []os.FileInfo{}
+	names := map[string]bool{}
+	cursor := ""
+	for {
+		list, err := self.storage.List(prefix, "/", cursor, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range list.Files {
+			infos = append(infos, &davFileInfo{v.FilePath, int64(v.Size), time.Unix(v.Created, 0), &FileNode{
+				HashNode: HashNode{Size: v.Size},
+				Mime:     v.Mime,
+				Metadata: v.Metadata,
+				Hash:     v.Hash,
+				Created:  v.Created,
+			}})
+		}
+		for _, v := range list.Prefixes {
+			dir := strings.TrimSuffix(v, "/")
+			names[dir] = true
+			infos = append(infos, newDavFileInfo(dir, nil))
+		}
+		if cursor = list.Cursor; len(cursor) < 1 {
+			break
+		}
+	}
+	self.dirLock.Lock()
+	for dir := range self.dirs {
+		if path.Dir(dir)+"/" == prefix || (path.Dir(dir) == "/" && prefix == "/") {
+			if !names[dir] {
+				infos = append(infos, newDavFileInfo(dir, nil))
+			}
+		}
+	}
+	self.dirLock.Unlock()
+	return infos, nil
+}
+
+func (self *davFileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	name = davCleanName(name)
+	if name != "/" {
+		fnode, err := self.storage.Stat(name)
+		if err == nil {
+			return newDavFileInfo(name, fnode), nil
+		} else if err != ErrNotExist {
+			return nil, err
+		}
+	}
+	ok, err := self.hasDir(name)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return newDavFileInfo(name, nil), nil
+}
+
+func (self *davFileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	name = davCleanName(name)
+	if _, err := self.Stat(ctx, name); err == nil {
+		return os.ErrExist
+	}
+	parent, err := self.Stat(ctx, path.Dir(name))
+	if err != nil {
+		return err
+	}
+	if !parent.IsDir() {
+		return os.ErrInvalid
+	}
+	self.dirLock.Lock()
+	self.dirs[name] = true
+	self.dirLock.Unlock()
+	return nil
+}
+
+func (self *davFileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	name = davCleanName(name)
+	if flag&(os.O_WRONLY|os.O_RDWR) != 0 {
+		if name == "/" {
+			return nil, os.ErrInvalid
+		}
+		if flag&os.O_CREATE == 0 {
+			if _, err := self.storage.Stat(name); err != nil {
+				return nil, err
+			}
+		}
+		length, ok := ctx.Value(davLengthKey{}).(int64)
+		if !ok {
+			length = -1
+		}
+		body, _ := ctx.Value(davBodyKey{}).(*authHashReader)
+		reader, writer := io.Pipe()
+		file := &davWriter{
+			name:   name,
+			length: length,
+			body:   body,
+			writer: writer,
+			done:   make(chan error, 1),
+		}
+		go func() {
+			_, err := self.storage.WriteStream(name, mime.TypeByExtension(path.Ext(name)), "", reader, nil)
+			reader.CloseWithError(err)
+			file.done <- err
+		}()
+		return file, nil
+	}
+
+	info, err := self.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		allow, _ := ctx.Value(davAllowKey{}).(func(string) bool)
+		return &davDir{fs: self, name: name, allow: allow}, nil
+	}
+	file, err := self.storage.OpenFile(name)
+	if err != nil {
+		return nil, err
+	}
+	return &davFile{file, newDavFileInfo(name, file.Node)}, nil
+}
+
+func (self *davFileSystem) RemoveAll(ctx context.Context, name string) error {
+	name = davCleanName(name)
+	if name == "/" {
+		return os.ErrPermission
+	}
+	err := self.storage.DeleteFile(name)
+	if err != ErrNotExist {
+		return err
+	}
+	found := false
+	for {
+		list, err := self.storage.List(name+"/", "", "", 0)
+		if err != nil {
+			return err
+		}
+		if len(list.Files) < 1 {
+			break
+		}
+		for _, v := range list.Files {
+			if err := self.storage.DeleteFile(v.FilePath); err != nil && err != ErrNotExist {
+				return err
+			}
+		}
+		found = true
+	}
+	self.dirLock.Lock()
+	for dir := range self.dirs {
+		if dir == name || strings.HasPrefix(dir, name+"/") {
+			delete(self.dirs, dir)
+			found = true
+		}
+	}
+	self.dirLock.Unlock()
+	if !found {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+func (self *davFileSystem) Rename(ctx context.Context, oldName string, newName string) error {
+	oldName, newName = davCleanName(oldName), davCleanName(newName)
+	if oldName == "/" || newName == "/" {
+		return os.ErrPermission
+	}
+	err := self.storage.Rename(oldName, newName, true)
+	if err != ErrNotExist {
+		return err
+	}
+	found := false
+	if _, err := self.storage.RenamePrefix(oldName+"/", newName+"/", true); err == nil {
+		found = true
+	} else if err != ErrNotExist {
+		return err
+	}
+	self.dirLock.Lock()
+	dirs := []string{}
+	for dir := range self.dirs {
+		if dir == oldName || strings.HasPrefix(dir, oldName+"/") {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range dirs {
+		delete(self.dirs, dir)
+		self.dirs[newName+dir[len(oldName):]] = true
+		found = true
+	}
+	self.dirLock.Unlock()
+	if !found {
+		return os.ErrNotExist
+	}
+	return nil
+}
+
+// The collection of name, its private prefixes are checked by the requests
+// on the whole tree.
+func davDirPrefix(name string) string {
+	return strings.TrimSuffix(name, "/") + "/"
+}
+
+func (self *HttpServer) authorizeWebDAV(req *http.Request) error {
+	name := davCleanName(req.URL.Path)
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "PROPFIND":
+		return self.authorize(req, AuthRead, name)
+	case "DELETE":
+		if err := self.authorize(req, AuthDelete, name); err != nil {
+			return err
+		}
+		return self.authorizePrivates(req, AuthDelete, davDirPrefix(name))
+	case "MOVE", "COPY":
+		operation := AuthRead
+		if req.Method == "MOVE" {
+			operation = AuthDelete
+		}
+		if err := self.authorize(req, operation, name); err != nil {
+			return err
+		}
+		if err := self.authorizePrivates(req, operation, davDirPrefix(name)); err != nil {
+			return err
+		}
+		dst, err := url.Parse(req.Header.Get("Destination"))
+		if err != nil {
+			return ErrParam
+		}
+		return self.authorize(req, AuthWrite, davCleanName(dst.Path))
+	}
+	return self.authorize(req, AuthWrite, name)
+}
+
+func (self *HttpServer) startWebDAV() {
+	handler := &webdav.Handler{
+		FileSystem: &davFileSystem{
+			storage: self.storage,
+			dirs:    map[string]bool{},
+		},
+		LockSystem: webdav.NewMemLS(),
+	}
+	server := &http.Server{
+		Handler: verifyContent(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if err := self.authorizeWebDAV(req); err != nil {
+				if len(req.Header.Get("Authorization")) < 1 {
+					res.Header().Set("WWW-Authenticate", "Basic realm=\"tinynfs\"")
+					http.Error(res, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+				} else {
+					http.Error(res, err.Error(), toStatusCode(err))
+				}
+				return
+			}
+			req = req.WithContext(context.WithValue(req.Context(), davAllowKey{}, func(name string) bool {
+				return self.authorize(req, AuthRead, name) == nil
+			}))
+			// The length to verify the body of PUT, -1 when unknown
+			if req.Method == "PUT" {
+				req = req.WithContext(context.WithValue(req.Context(), davLengthKey{}, req.ContentLength))
+				if body, ok := req.Body.(*authHashReader); ok {
+					req = req.WithContext(context.WithValue(req.Context(), davBodyKey{}, body))
+				}
+			}
+			handler.ServeHTTP(res, req)
+		})),
+	}
+	err := server.Serve(self.webdavListener)
+	if err != nil && !self.closed {
+		fmt.Println(err)
+	}
+}
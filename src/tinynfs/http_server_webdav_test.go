@@ -0,0 +1,84 @@
+package tinynfs
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWebDAVFileSystem(t *testing.T) {
+	fs, err := NewFileSystem(filepath.Join("../../test", "data-fs-webdav"), &Storage{
+		DiskRemain:       4 * 1024 * 1024,
+		SnapshotInterval: 600,
+		SnapshotReserve:  3,
+		VolumeSliceSize:  4 * 1024 * 1024 * 1024,
+		VolumeFileGroups: []VolumeGroup{
+			VolumeGroup{
+				Id:   0,
+				Path: "{{DATA}}/volumes/",
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer fs.Close()
+
+	ctx := context.Background()
+	dav := &davFileSystem{storage: fs, dirs: map[string]bool{}}
+	if err := dav.Mkdir(ctx, "/dav/", 0755); err != nil {
+		t.Error("Mkdir error", err)
+	}
+	file, err := dav.OpenFile(ctx, "/dav/sub/a.txt", os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal("Open write error", err)
+	}
+	file.Write(fsTestBuffer)
+	if err := file.Close(); err != nil {
+		t.Error("Close write error", err)
+	}
+	if err := dav.Rename(ctx, "/dav/sub", "/dav/new"); err != nil {
+		t.Error("Rename error", err)
+	}
+	file, err = dav.OpenFile(ctx, "/dav", 0, 0)
+	if err != nil {
+		t.Fatal("Open dir error", err)
+	}
+	infos, err := file.Readdir(0)
+	if err != nil || len(infos) != 1 || infos[0].Name() != "new" || !infos[0].IsDir() {
+		t.Error("Readdir mismatch", infos, err)
+	}
+	file, err = dav.OpenFile(ctx, "/dav/new/a.txt", 0, 0)
+	if err != nil {
+		t.Fatal("Open read error", err)
+	}
+	data, err := ioutil.ReadAll(file)
+	file.Close()
+	if err != nil || len(data) != len(fsTestBuffer) {
+		t.Error("Read mismatch", len(data), err)
+	}
+	// The short body of PUT must not replace the file
+	lctx := context.WithValue(ctx, davLengthKey{}, int64(len(fsTestBuffer)+1))
+	file, err = dav.OpenFile(lctx, "/dav/new/a.txt", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal("Open write error", err)
+	}
+	file.Write([]byte("short"))
+	if err := file.Close(); err == nil {
+		t.Error("Close short body without error")
+	}
+	if _, _, data, err := fs.ReadFile("/dav/new/a.txt"); err != nil || !bytes.Equal(data, fsTestBuffer) {
+		t.Error("Short body replaced file", len(data), err)
+	}
+	if err := dav.RemoveAll(ctx, "/dav"); err != nil {
+		t.Error("RemoveAll error", err)
+	}
+	if _, err := dav.Stat(ctx, "/dav"); err != ErrNotExist {
+		t.Error("RemoveAll dir exists", err)
+	} else {
+		t.Log("WebDAV success")
+	}
+}
@@ -0,0 +1,341 @@
+package tinynfs
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	s3Algorithm        = "AWS4-HMAC-SHA256"
+	s3TimeFormat       = "20060102T150405Z"
+	s3MaxClockSkew     = 15 * time.Minute
+	s3MaxPresignExpire = 7 * 24 * 3600
+	s3MaxChunkSize     = 16 * 1024 * 1024
+
+	s3UnsignedPayload          = "UNSIGNED-PAYLOAD"
+	s3StreamingPayload         = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3StreamingUnsignedTrailer = "STREAMING-UNSIGNED-PAYLOAD-TRAILER"
+)
+
+var (
+	s3EmptyHash = hex.EncodeToString(sha256.New().Sum(nil))
+)
+
+type s3Signature struct {
+	accessKey  string
+	timestamp  string
+	scope      string
+	signingKey []byte
+	signature  string
+	payload    string
+}
+
+func s3HmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func s3SHA256Hex(data []byte) string {
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:])
+}
+
+func s3SigningKey(secret string, date string, region string) []byte {
+	key := s3HmacSHA256([]byte("AWS4"+secret), date)
+	key = s3HmacSHA256(key, region)
+	key = s3HmacSHA256(key, "s3")
+	return s3HmacSHA256(key, "aws4_request")
+}
+
+// The URI encoding of SigV4, only the unreserved characters are kept
+func s3URIEncode(s string, path bool) string {
+	var buf bytes.Buffer
+	for _, c := range []byte(s) {
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (path && c == '/') {
+			buf.WriteByte(c)
+		} else {
+			buf.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return buf.String()
+}
+
+func s3CanonicalQuery(query url.Values) string {
+	pairs := []string{}
+	for k, vs := range query {
+		if k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, s3URIEncode(k, false)+"="+s3URIEncode(v, false))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func s3CanonicalRequest(req *http.Request, signedHeaders []string, payload string) string {
+	headers := []string{}
+	for _, name := range signedHeaders {
+		values := []string{}
+		if name == "host" {
+			values = append(values, req.Host)
+		} else {
+			for _, v := range req.Header[http.CanonicalHeaderKey(name)] {
+				values = append(values, strings.Join(strings.Fields(v), " "))
+			}
+		}
+		headers = append(headers, name+":"+strings.Join(values, ",")+"\n")
+	}
+	return strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, true),
+		s3CanonicalQuery(req.URL.Query()),
+		strings.Join(headers, ""),
+		strings.Join(signedHeaders, ";"),
+		payload,
+	}, "\n")
+}
+
+func s3StringToSign(timestamp string, scope string, canonical string) string {
+	return s3Algorithm + "\n" + timestamp + "\n" + scope + "\n" + s3SHA256Hex([]byte(canonical))
+}
+
+func s3ParseCredential(credential string, region string) (string, string, error) {
+	fields := strings.Split(credential, "/")
+	if len(fields) != 5 || fields[3] != "s3" || fields[4] != "aws4_request" {
+		return "", "", s3ErrAuthorizationHeaderMalformed
+	}
+	if fields[2] != region {
+		return "", "", s3ErrAuthorizationHeaderMalformed
+	}
+	return fields[0], fields[1], nil
+}
+
+// s3Authenticate verifies the SigV4 of the request by the Authorization
+// header or the presigned query.
+func (self *HttpServer) s3Authenticate(req *http.Request) (*s3Signature, error) {
+	var (
+		credential    string
+		signedHeaders string
+		signature     string
+		timestamp     string
+		payload       string
+		expires       int64
+	)
+	query := req.URL.Query()
+	if auth := req.Header.Get("Authorization"); len(auth) > 0 {
+		if !strings.HasPrefix(auth, s3Algorithm+" ") {
+			return nil, s3ErrAuthorizationHeaderMalformed
+		}
+		for _, field := range strings.Split(auth[len(s3Algorithm)+1:], ",") {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) != 2 {
+				return nil, s3ErrAuthorizationHeaderMalformed
+			}
+			switch kv[0] {
+			case "Credential":
+				credential = kv[1]
+			case "SignedHeaders":
+				signedHeaders = kv[1]
+			case "Signature":
+				signature = kv[1]
+			}
+		}
+		timestamp = req.Header.Get("X-Amz-Date")
+		payload = req.Header.Get("X-Amz-Content-Sha256")
+		switch payload {
+		case s3UnsignedPayload, s3StreamingPayload, s3StreamingUnsignedTrailer:
+		default:
+			if b, err := hex.DecodeString(payload); err != nil || len(b) != sha256.Size {
+				return nil, s3ErrInvalidRequest
+			}
+		}
+	} else if len(query.Get("X-Amz-Signature")) > 0 {
+		if query.Get("X-Amz-Algorithm") != s3Algorithm {
+			return nil, s3ErrAuthorizationQueryMalformed
+		}
+		credential = query.Get("X-Amz-Credential")
+		signedHeaders = query.Get("X-Amz-SignedHeaders")
+		signature = query.Get("X-Amz-Signature")
+		timestamp = query.Get("X-Amz-Date")
+		payload = s3UnsignedPayload
+		n, err := strconv.ParseInt(query.Get("X-Amz-Expires"), 10, 64)
+		if err != nil || n < 1 || n > s3MaxPresignExpire {
+			return nil, s3ErrAuthorizationQueryMalformed
+		}
+		expires = n
+	} else {
+		return nil, s3ErrAccessDenied
+	}
+	if len(credential) < 1 || len(signedHeaders) < 1 || len(signature) < 1 {
+		return nil, s3ErrAuthorizationHeaderMalformed
+	}
+
+	accessKey, date, err := s3ParseCredential(credential, self.config.S3Region)
+	if err != nil {
+		return nil, err
+	}
+	secret, ok := self.config.S3Credentials[accessKey]
+	if !ok {
+		return nil, s3ErrInvalidAccessKeyId
+	}
+	signTime, err := time.Parse(s3TimeFormat, timestamp)
+	if err != nil || signTime.Format("20060102") != date {
+		return nil, s3ErrAccessDenied
+	}
+	now := time.Now()
+	if expires > 0 {
+		if now.Before(signTime.Add(-s3MaxClockSkew)) || now.After(signTime.Add(time.Duration(expires)*time.Second)) {
+			return nil, s3ErrExpiredRequest
+		}
+	} else if now.Sub(signTime) > s3MaxClockSkew || signTime.Sub(now) > s3MaxClockSkew {
+		return nil, s3ErrRequestTimeTooSkewed
+	}
+
+	headers := strings.Split(signedHeaders, ";")
+	if !sort.StringsAreSorted(headers) {
+		return nil, s3ErrAuthorizationHeaderMalformed
+	}
+	scope := strings.Join([]string{date, self.config.S3Region, "s3", "aws4_request"}, "/")
+	signingKey := s3SigningKey(secret, date, self.config.S3Region)
+	canonical := s3CanonicalRequest(req, headers, payload)
+	expected := hex.EncodeToString(s3HmacSHA256(signingKey, s3StringToSign(timestamp, scope, canonical)))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return nil, s3ErrSignatureDoesNotMatch
+	}
+	return &s3Signature{
+		accessKey:  accessKey,
+		timestamp:  timestamp,
+		scope:      scope,
+		signingKey: signingKey,
+		signature:  signature,
+		payload:    payload,
+	}, nil
+}
+
+// The request body verified by the payload hash at the end
+type s3HashReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	expect string
+}
+
+func (self *s3HashReader) Read(p []byte) (int, error) {
+	n, err := self.reader.Read(p)
+	self.hash.Write(p[:n])
+	if err == io.EOF && hex.EncodeToString(self.hash.Sum(nil)) != self.expect {
+		return n, s3ErrXAmzContentSHA256Mismatch
+	}
+	return n, err
+}
+
+// The request body of aws-chunked encoding, the signature of every chunk
+// is verified when it was signed.
+type s3ChunkedReader struct {
+	reader    *bufio.Reader
+	signature *s3Signature
+	previous  string
+	chunk     []byte
+	done      bool
+}
+
+func (self *s3ChunkedReader) readChunk() error {
+	line, err := self.reader.ReadString('\n')
+	if err != nil {
+		return s3ErrIncompleteBody
+	}
+	fields := strings.SplitN(strings.TrimRight(line, "\r\n"), ";", 2)
+	size, err := strconv.ParseInt(fields[0], 16, 64)
+	if err != nil || size < 0 || size > s3MaxChunkSize {
+		return s3ErrIncompleteBody
+	}
+	chunk := make([]byte, size)
+	if _, err := io.ReadFull(self.reader, chunk); err != nil {
+		return s3ErrIncompleteBody
+	}
+	if size > 0 {
+		if crlf, err := self.reader.ReadString('\n'); err != nil || crlf != "\r\n" {
+			return s3ErrIncompleteBody
+		}
+	}
+	if self.signature != nil {
+		if len(fields) != 2 || !strings.HasPrefix(fields[1], "chunk-signature=") {
+			return s3ErrIncompleteBody
+		}
+		toSign := strings.Join([]string{
+			"AWS4-HMAC-SHA256-PAYLOAD",
+			self.signature.timestamp,
+			self.signature.scope,
+			self.previous,
+			s3EmptyHash,
+			s3SHA256Hex(chunk),
+		}, "\n")
+		expected := hex.EncodeToString(s3HmacSHA256(self.signature.signingKey, toSign))
+		if !hmac.Equal([]byte(expected), []byte(fields[1][len("chunk-signature="):])) {
+			return s3ErrSignatureDoesNotMatch
+		}
+		self.previous = expected
+	}
+	if size == 0 {
+		// Skip the trailing headers
+		for {
+			line, err := self.reader.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+		}
+		self.done = true
+	}
+	self.chunk = chunk
+	return nil
+}
+
+func (self *s3ChunkedReader) Read(p []byte) (int, error) {
+	for len(self.chunk) < 1 {
+		if self.done {
+			return 0, io.EOF
+		}
+		if err := self.readChunk(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, self.chunk)
+	self.chunk = self.chunk[n:]
+	return n, nil
+}
+
+func s3PayloadReader(req *http.Request, signature *s3Signature) io.Reader {
+	switch signature.payload {
+	case s3UnsignedPayload:
+		return req.Body
+	case s3StreamingPayload:
+		return &s3ChunkedReader{
+			reader:    bufio.NewReader(req.Body),
+			signature: signature,
+			previous:  signature.signature,
+		}
+	case s3StreamingUnsignedTrailer:
+		return &s3ChunkedReader{
+			reader: bufio.NewReader(req.Body),
+		}
+	}
+	return &s3HashReader{
+		reader: req.Body,
+		hash:   sha256.New(),
+		expect: signature.payload,
+	}
+}
@@ -0,0 +1,28 @@
+package tinynfs
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+)
+
+func TestS3Signature(t *testing.T) {
+	// The example of AWS Signature Version 4 document
+	req, _ := http.NewRequest("GET", "https://examplebucket.s3.amazonaws.com/test.txt", nil)
+	req.Header.Set("Range", "bytes=0-9")
+	req.Header.Set("X-Amz-Content-Sha256", s3EmptyHash)
+	req.Header.Set("X-Amz-Date", "20130524T000000Z")
+	headers := []string{"host", "range", "x-amz-content-sha256", "x-amz-date"}
+	canonical := s3CanonicalRequest(req, headers, s3EmptyHash)
+	signingKey := s3SigningKey("wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY", "20130524", "us-east-1")
+	toSign := s3StringToSign("20130524T000000Z", "20130524/us-east-1/s3/aws4_request", canonical)
+	signature := hex.EncodeToString(s3HmacSHA256(signingKey, toSign))
+	if signature != "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41" {
+		t.Error("Signature mismatch: " + signature)
+	} else {
+		t.Log("Signature success: " + signature)
+	}
+	if v := s3URIEncode("/a b/c+d~", true); v != "/a%20b/c%2Bd~" {
+		t.Error("URI encode mismatch: " + v)
+	}
+}
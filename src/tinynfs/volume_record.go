@@ -0,0 +1,201 @@
+package tinynfs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+)
+
+// Volume file layout (version 1):
+//
+//	volume header: "TINYNFS" version(1)
+//	record header: "TNFR" kind(1) flags(1) timestamp(8) size(8) sha256(32)
+//	               mime length(2) mime, path length(2) path,
+//	               [extra length(4) extra], header length(4)
+//	record data:   size bytes
+//	record footer: "TNFE" crc32 of data(4) record length(8)
+//
+// The volume file without volume header is version 0, it is raw data only.
+// The data record also links its file path to the sha256, the link record
+// and the delete record have no data.
+const (
+	VolumeVersionRaw    = 0
+	VolumeVersionRecord = 1
+
+	RecordKindData   = 1
+	RecordKindLink   = 2
+	RecordKindDelete = 3
+
+	recordFlagExtra = 0x01
+
+	volumeHeaderSize   = 8
+	recordFixedSize    = 4 + 1 + 1 + 8 + 8 + sha256.Size + 2 + 2 + 4
+	recordFooterSize   = 4 + 4 + 8
+	recordMaxFieldSize = 0xFFFF
+	recordMaxExtraSize = 1024 * 1024
+)
+
+var (
+	volumeMagic       = []byte("TINYNFS")
+	recordHeaderMagic = []byte("TNFR")
+	recordFooterMagic = []byte("TNFE")
+)
+
+type VolumeRecord struct {
+	Kind      byte
+	Timestamp int64
+	Size      int
+	Hash      []byte
+	Mime      string
+	FilePath  string
+	Extra     []byte
+	Offset    int64
+}
+
+func makeVolumeHeader(version byte) []byte {
+	return append(append([]byte{}, volumeMagic...), version)
+}
+
+func parseVolumeHeader(header []byte) int {
+	if len(header) < volumeHeaderSize || !bytes.Equal(header[:len(volumeMagic)], volumeMagic) {
+		return VolumeVersionRaw
+	}
+	return int(header[len(volumeMagic)])
+}
+
+func encodeRecordHeader(record *VolumeRecord) []byte {
+	mime := []byte(record.Mime)
+	if len(mime) > recordMaxFieldSize {
+		mime = mime[:recordMaxFieldSize]
+	}
+	path := []byte(record.FilePath)
+	if len(path) > recordMaxFieldSize {
+		path = path[:recordMaxFieldSize]
+	}
+	size := recordFixedSize + len(mime) + len(path)
+	extra := record.Extra
+	if len(extra) > recordMaxExtraSize {
+		extra = nil
+	}
+	if len(extra) > 0 {
+		size += 4 + len(extra)
+	}
+	header := make([]byte, size)
+	copy(header[0:4], recordHeaderMagic)
+	header[4] = record.Kind
+	if len(extra) > 0 {
+		header[5] |= recordFlagExtra
+	}
+	binary.BigEndian.PutUint64(header[6:14], uint64(record.Timestamp))
+	binary.BigEndian.PutUint64(header[14:22], uint64(record.Size))
+	copy(header[22:54], record.Hash)
+	pos := 54
+	binary.BigEndian.PutUint16(header[pos:], uint16(len(mime)))
+	pos += 2 + copy(header[pos+2:], mime)
+	binary.BigEndian.PutUint16(header[pos:], uint16(len(path)))
+	pos += 2 + copy(header[pos+2:], path)
+	if len(extra) > 0 {
+		binary.BigEndian.PutUint32(header[pos:], uint32(len(extra)))
+		pos += 4 + copy(header[pos+4:], extra)
+	}
+	binary.BigEndian.PutUint32(header[pos:], uint32(size))
+	return header
+}
+
+func decodeRecordHeader(header []byte) (*VolumeRecord, error) {
+	if len(header) < recordFixedSize || !bytes.Equal(header[0:4], recordHeaderMagic) {
+		return nil, ErrVolumeRecord
+	}
+	record := &VolumeRecord{
+		Kind:      header[4],
+		Timestamp: int64(binary.BigEndian.Uint64(header[6:14])),
+		Size:      int(binary.BigEndian.Uint64(header[14:22])),
+		Hash:      append([]byte{}, header[22:54]...),
+	}
+	pos := 54
+	n := int(binary.BigEndian.Uint16(header[pos:]))
+	if pos+2+n > len(header)-6 {
+		return nil, ErrVolumeRecord
+	}
+	record.Mime = string(header[pos+2 : pos+2+n])
+	pos += 2 + n
+	n = int(binary.BigEndian.Uint16(header[pos:]))
+	if pos+2+n > len(header)-4 {
+		return nil, ErrVolumeRecord
+	}
+	record.FilePath = string(header[pos+2 : pos+2+n])
+	pos += 2 + n
+	if header[5]&recordFlagExtra != 0 {
+		if pos+4 > len(header)-4 {
+			return nil, ErrVolumeRecord
+		}
+		n = int(binary.BigEndian.Uint32(header[pos:]))
+		if pos+4+n > len(header)-4 {
+			return nil, ErrVolumeRecord
+		}
+		record.Extra = append([]byte{}, header[pos+4:pos+4+n]...)
+		pos += 4 + n
+	}
+	if pos != len(header)-4 {
+		return nil, ErrVolumeRecord
+	}
+	if int(binary.BigEndian.Uint32(header[len(header)-4:])) != len(header) {
+		return nil, ErrVolumeRecord
+	}
+	return record, nil
+}
+
+func encodeRecordFooter(checksum uint32, length int64) []byte {
+	footer := make([]byte, recordFooterSize)
+	copy(footer[0:4], recordFooterMagic)
+	binary.BigEndian.PutUint32(footer[4:8], checksum)
+	binary.BigEndian.PutUint64(footer[8:16], uint64(length))
+	return footer
+}
+
+func decodeRecordFooter(footer []byte) (uint32, int64, error) {
+	if len(footer) != recordFooterSize || !bytes.Equal(footer[0:4], recordFooterMagic) {
+		return 0, 0, ErrVolumeRecord
+	}
+	return binary.BigEndian.Uint32(footer[4:8]), int64(binary.BigEndian.Uint64(footer[8:16])), nil
+}
+
+func readRecordHeader(reader io.Reader) (*VolumeRecord, int, error) {
+	fixed := make([]byte, 56)
+	if _, err := io.ReadFull(reader, fixed); err != nil {
+		return nil, 0, err
+	}
+	if !bytes.Equal(fixed[0:4], recordHeaderMagic) {
+		return nil, 0, ErrVolumeRecord
+	}
+	mimeLen := int(binary.BigEndian.Uint16(fixed[54:56]))
+	rest := make([]byte, mimeLen+2)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, 0, err
+	}
+	pathLen := int(binary.BigEndian.Uint16(rest[mimeLen:]))
+	tailLen := pathLen + 4
+	if fixed[5]&recordFlagExtra != 0 {
+		more := make([]byte, pathLen+4)
+		if _, err := io.ReadFull(reader, more); err != nil {
+			return nil, 0, err
+		}
+		rest = append(rest, more...)
+		extraLen := int(binary.BigEndian.Uint32(more[pathLen:]))
+		if extraLen > recordMaxExtraSize {
+			return nil, 0, ErrVolumeRecord
+		}
+		tailLen = extraLen + 4
+	}
+	tail := make([]byte, tailLen)
+	if _, err := io.ReadFull(reader, tail); err != nil {
+		return nil, 0, err
+	}
+	header := append(append(fixed, rest...), tail...)
+	record, err := decodeRecordHeader(header)
+	if err != nil {
+		return nil, 0, err
+	}
+	return record, len(header), nil
+}
@@ -1,11 +1,18 @@
 package tinynfs
 
 import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"sync"
 	"time"
@@ -16,11 +23,27 @@ const (
 )
 
 type VolumeFile struct {
-	id    int64
-	size  int64
-	rFile *os.File
-	wFile *os.File
-	wLock sync.Mutex
+	id      int64
+	size    int64
+	version int
+	rFile   *os.File
+	wFile   *os.File
+	wLock   sync.Mutex
+	rLock   sync.RWMutex
+	closed  bool
+}
+
+type VolumeReader struct {
+	*io.SectionReader
+	volume *VolumeFile
+}
+
+func (self *VolumeReader) Close() error {
+	if self.volume != nil {
+		self.volume.rLock.RUnlock()
+		self.volume = nil
+	}
+	return nil
 }
 
 type VolumeStorage struct {
@@ -59,7 +82,8 @@ func (self *VolumeStorage) init() error {
 				if err != nil {
 					log.Println(fmt.Sprintf("load failed %s %s", name, err))
 				} else {
-					if v.size < self.sliceSize {
+					// Never append record to raw volume
+					if v.size < self.sliceSize && v.version == VolumeVersionRecord {
 						self.volumes[v.id] = v
 					}
 					self.volumeMap[v.id] = v
@@ -81,8 +105,12 @@ func (self *VolumeStorage) Close() {
 	self.volumePlock.Unlock()
 }
 
+func (self *VolumeStorage) volumePath(id int64) string {
+	return self.root + fmt.Sprintf("/volume-%d", id)
+}
+
 func (self *VolumeStorage) makeFile(id int64, size int64) (*VolumeFile, error) {
-	fullpath := self.root + fmt.Sprintf("/volume-%d", id)
+	fullpath := self.volumePath(id)
 	w, err := os.OpenFile(fullpath, os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return nil, err
@@ -98,9 +126,30 @@ func (self *VolumeStorage) makeFile(id int64, size int64) (*VolumeFile, error) {
 		rFile: r,
 		wFile: w,
 	}
+	if size > 0 {
+		header := make([]byte, volumeHeaderSize)
+		if n, _ := r.ReadAt(header, 0); n == volumeHeaderSize {
+			v.version = parseVolumeHeader(header)
+		}
+	} else {
+		if _, err := w.WriteAt(makeVolumeHeader(VolumeVersionRecord), 0); err != nil {
+			r.Close()
+			w.Close()
+			return nil, err
+		}
+		v.size = volumeHeaderSize
+		v.version = VolumeVersionRecord
+	}
 	return v, nil
 }
 
+func (self *VolumeStorage) getVolume(id int64) *VolumeFile {
+	self.volumeLock.Lock()
+	defer self.volumeLock.Unlock()
+
+	return self.volumeMap[id]
+}
+
 func (self *VolumeStorage) requireVolume() (*VolumeFile, error) {
 	self.volumeLock.Lock()
 	defer self.volumeLock.Unlock()
@@ -136,13 +185,17 @@ func (self *VolumeStorage) IsFully() (bool, error) {
 }
 
 func (self *VolumeStorage) ReadFile(id int64, offset int64, size int) ([]byte, error) {
-	self.volumeLock.Lock()
-	v := self.volumeMap[id]
-	self.volumeLock.Unlock()
+	v := self.getVolume(id)
 	if v == nil {
 		return nil, ErrNotExist
 	}
 
+	v.rLock.RLock()
+	defer v.rLock.RUnlock()
+	if v.closed {
+		return nil, ErrNotExist
+	}
+
 	data := make([]byte, size)
 	if _, err := v.rFile.ReadAt(data, offset); err != nil {
 		return nil, err
@@ -150,7 +203,132 @@ func (self *VolumeStorage) ReadFile(id int64, offset int64, size int) ([]byte, e
 	return data, nil
 }
 
-func (self *VolumeStorage) WriteFile(data []byte) (int64, int64, error) {
+func (self *VolumeStorage) OpenFile(id int64, offset int64, size int) (*VolumeReader, error) {
+	v := self.getVolume(id)
+	if v == nil {
+		return nil, ErrNotExist
+	}
+
+	v.rLock.RLock()
+	if v.closed {
+		v.rLock.RUnlock()
+		return nil, ErrNotExist
+	}
+	return &VolumeReader{
+		SectionReader: io.NewSectionReader(v.rFile, offset, int64(size)),
+		volume:        v,
+	}, nil
+}
+
+func (self *VolumeStorage) ReadRecord(id int64, offset int64, size int) (*VolumeRecord, []byte, error) {
+	v := self.getVolume(id)
+	if v == nil {
+		return nil, nil, ErrNotExist
+	}
+
+	v.rLock.RLock()
+	defer v.rLock.RUnlock()
+	if v.closed {
+		return nil, nil, ErrNotExist
+	}
+
+	data := make([]byte, size)
+	if _, err := v.rFile.ReadAt(data, offset); err != nil {
+		return nil, nil, err
+	}
+	if v.version == VolumeVersionRaw {
+		return nil, data, nil
+	}
+	// The header length was saved in the end of header
+	back := make([]byte, 4)
+	if _, err := v.rFile.ReadAt(back, offset-4); err != nil {
+		return nil, nil, err
+	}
+	hlen := int64(binary.BigEndian.Uint32(back))
+	if hlen < recordFixedSize || hlen > offset-volumeHeaderSize {
+		return nil, nil, ErrVolumeRecord
+	}
+	header := make([]byte, hlen)
+	if _, err := v.rFile.ReadAt(header, offset-hlen); err != nil {
+		return nil, nil, err
+	}
+	record, err := decodeRecordHeader(header)
+	if err != nil {
+		return nil, nil, err
+	}
+	if record.Size != size {
+		return nil, nil, ErrVolumeRecord
+	}
+	record.Offset = offset
+	return record, data, nil
+}
+
+func (self *VolumeStorage) WalkVolume(id int64, walkFn func(record *VolumeRecord) error) error {
+	v := self.getVolume(id)
+	if v == nil {
+		return ErrNotExist
+	}
+
+	v.rLock.RLock()
+	defer v.rLock.RUnlock()
+	if v.closed {
+		return ErrNotExist
+	}
+	if v.version != VolumeVersionRecord {
+		return ErrVolumeVersion
+	}
+
+	v.wLock.Lock()
+	size := v.size
+	v.wLock.Unlock()
+
+	offset := int64(volumeHeaderSize)
+	reader := bufio.NewReaderSize(io.NewSectionReader(v.rFile, offset, size-offset), 1024*1024)
+	footer := make([]byte, recordFooterSize)
+	for offset < size {
+		record, hlen, err := readRecordHeader(reader)
+		if err != nil {
+			return ErrVolumeRecord
+		}
+		checksum := crc32.NewIEEE()
+		if _, err := io.CopyN(checksum, reader, int64(record.Size)); err != nil {
+			return ErrVolumeRecord
+		}
+		if _, err := io.ReadFull(reader, footer); err != nil {
+			return ErrVolumeRecord
+		}
+		sum, length, err := decodeRecordFooter(footer)
+		if err != nil || sum != checksum.Sum32() || length != int64(hlen+record.Size+recordFooterSize) {
+			return ErrVolumeRecord
+		}
+		record.Offset = offset + int64(hlen)
+		if err := walkFn(record); err != nil {
+			return err
+		}
+		offset += length
+	}
+	return nil
+}
+
+func (self *VolumeStorage) WriteFile(data []byte, record *VolumeRecord) (int64, int64, error) {
+	xrecord := VolumeRecord{
+		Kind: RecordKindData,
+	}
+	if record != nil {
+		xrecord = *record
+	}
+	if xrecord.Kind == RecordKindData && len(xrecord.Hash) != sha256.Size {
+		hash := sha256.Sum256(data)
+		xrecord.Hash = hash[:]
+	}
+	return self.WriteFrom(bytes.NewReader(data), int64(len(data)), &xrecord)
+}
+
+func (self *VolumeStorage) WriteFrom(reader io.Reader, size int64, record *VolumeRecord) (int64, int64, error) {
+	if record.Kind == RecordKindData && len(record.Hash) != sha256.Size {
+		return 0, 0, ErrParam
+	}
+
 	v, err := self.requireVolume()
 	if err != nil {
 		return 0, 0, err
@@ -163,22 +341,115 @@ func (self *VolumeStorage) WriteFile(data []byte) (int64, int64, error) {
 		return 0, 0, ErrVolumeStorageFully
 	}
 
+	xrecord := *record
+	xrecord.Size = int(size)
+	if xrecord.Timestamp == 0 {
+		xrecord.Timestamp = time.Now().UnixNano()
+	}
+	header := encodeRecordHeader(&xrecord)
+
 	v.wLock.Lock()
 	defer v.wLock.Unlock()
 
 	offset := v.size
-	n, err := v.wFile.WriteAt(data, offset)
-	if err != nil {
+	position := offset
+	// Discard the partial record when failed
+	failed := func(err error) (int64, int64, error) {
+		v.wFile.Truncate(offset)
 		return 0, 0, err
 	}
+	if _, err := v.wFile.WriteAt(header, position); err != nil {
+		return failed(err)
+	}
+	position += int64(len(header))
+	checksum := crc32.NewIEEE()
+	buffer := make([]byte, 256*1024)
+	for remain := size; remain > 0; {
+		n := int64(len(buffer))
+		if n > remain {
+			n = remain
+		}
+		if _, err := io.ReadFull(reader, buffer[:n]); err != nil {
+			return failed(err)
+		}
+		if _, err := v.wFile.WriteAt(buffer[:n], position); err != nil {
+			return failed(err)
+		}
+		checksum.Write(buffer[:n])
+		position += n
+		remain -= n
+	}
+	footer := encodeRecordFooter(checksum.Sum32(), int64(len(header))+size+recordFooterSize)
+	if _, err := v.wFile.WriteAt(footer, position); err != nil {
+		return failed(err)
+	}
+	position += recordFooterSize
 	v.wFile.Sync()
-	v.size += int64(n)
+	v.size = position
 	if v.size >= self.sliceSize {
 		self.volumeLock.Lock()
 		delete(self.volumes, v.id)
 		self.volumeLock.Unlock()
 	}
-	return v.id, offset, nil
+	return v.id, offset + int64(len(header)), nil
+}
+
+func (self *VolumeStorage) VolumeIds() []int64 {
+	self.volumeLock.Lock()
+	defer self.volumeLock.Unlock()
+
+	ids := make([]int64, 0, len(self.volumeMap))
+	for id := range self.volumeMap {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	return ids
+}
+
+func (self *VolumeStorage) VolumeVersion(id int64) int {
+	v := self.getVolume(id)
+	if v == nil {
+		return VolumeVersionRaw
+	}
+	return v.version
+}
+
+func (self *VolumeStorage) SealedVolumes() map[int64]int64 {
+	self.volumeLock.Lock()
+	defer self.volumeLock.Unlock()
+
+	sealed := map[int64]int64{}
+	for id, v := range self.volumeMap {
+		if _, ok := self.volumes[id]; !ok {
+			sealed[id] = v.size
+		}
+	}
+	return sealed
+}
+
+func (self *VolumeStorage) RemoveVolume(id int64) error {
+	self.volumeLock.Lock()
+	v := self.volumeMap[id]
+	if v == nil {
+		self.volumeLock.Unlock()
+		return ErrNotExist
+	}
+	if _, ok := self.volumes[id]; ok {
+		self.volumeLock.Unlock()
+		return ErrPermission
+	}
+	delete(self.volumeMap, id)
+	self.volumeLock.Unlock()
+
+	// Wait the pending reads
+	v.rLock.Lock()
+	v.closed = true
+	v.rFile.Close()
+	v.wFile.Close()
+	v.rLock.Unlock()
+	return os.Remove(self.volumePath(id))
 }
 
 func NewVolumeStorage(root string, sliceSize int64, diskRemain int64) (*VolumeStorage, error) {
@@ -12,7 +12,7 @@ var (
 
 func TestVolumeStorage(t *testing.T) {
 	bstorage, _ := NewVolumeStorage(filepath.Join("../../test", "data-volumes"), int64(len(volumeTestBuffer)+1), 50*1024)
-	id, offset, err := bstorage.WriteFile(volumeTestBuffer)
+	id, offset, err := bstorage.WriteFile(volumeTestBuffer, nil)
 	if err != nil {
 		t.Error("WriteFile error", err)
 	} else {
@@ -25,3 +25,40 @@ func TestVolumeStorage(t *testing.T) {
 		t.Log("ReadFile success: " + string(data))
 	}
 }
+
+func TestVolumeStorageRecord(t *testing.T) {
+	bstorage, err := NewVolumeStorage(filepath.Join("../../test", "data-volumes-record"), 1024*1024, 50*1024)
+	if err != nil {
+		t.Fatal("Create", err)
+	}
+	defer bstorage.Close()
+
+	id, offset, err := bstorage.WriteFile(volumeTestBuffer, &VolumeRecord{
+		Kind:     RecordKindData,
+		Mime:     "text/plain",
+		FilePath: "/record/a",
+	})
+	if err != nil {
+		t.Fatal("WriteFile error", err)
+	}
+	record, data, err := bstorage.ReadRecord(id, offset, len(volumeTestBuffer))
+	if err != nil {
+		t.Error("ReadRecord error", err)
+	} else if record.FilePath != "/record/a" || string(data) != string(volumeTestBuffer) {
+		t.Error("ReadRecord mismatch: " + record.FilePath)
+	} else {
+		t.Log("ReadRecord success: " + record.Mime + " " + record.FilePath)
+	}
+	found := false
+	err = bstorage.WalkVolume(id, func(record *VolumeRecord) error {
+		if record.Offset == offset && record.FilePath == "/record/a" {
+			found = true
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error("WalkVolume error", err)
+	} else if !found {
+		t.Error("WalkVolume record not found")
+	}
+}
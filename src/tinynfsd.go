@@ -13,11 +13,15 @@ import (
 var (
 	version = "1.1"
 	command = struct {
-		h bool
-		t bool
-		T bool
-		c string
-		d string
+		h               bool
+		t               bool
+		T               bool
+		c               string
+		d               string
+		rebuildIndex    bool
+		listSnapshots   bool
+		restoreSnapshot string
+		readOnly        bool
 	}{}
 )
 
@@ -27,6 +31,10 @@ func init() {
 	flag.BoolVar(&command.t, "t", false, "test configuration and exit")
 	flag.StringVar(&command.c, "c", "etc/tinynfsd.conf", "set configuration `file`")
 	flag.StringVar(&command.d, "d", "data/", "set data storage `path`")
+	flag.BoolVar(&command.rebuildIndex, "rebuild-index", false, "rebuild index storage from volumes and exit")
+	flag.BoolVar(&command.listSnapshots, "list-snapshots", false, "list snapshots of index storage and exit")
+	flag.StringVar(&command.restoreSnapshot, "restore-snapshot", "", "restore index storage from snapshot `file` and exit")
+	flag.BoolVar(&command.readOnly, "readonly", false, "serve reads only, refuse writes")
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "tinynfsd version: %s\n\nOptions:\n", version)
 		flag.PrintDefaults()
@@ -67,10 +75,70 @@ func main() {
 	config, err := tinynfs.NewConfig(cfile)
 	if err != nil {
 		log.Fatalln(err)
-	} else if command.T {
+	}
+	if command.readOnly {
+		config.Storage.ReadOnly = true
+	}
+	if command.T {
 		fmt.Println(config.Dump())
 	}
 
+	if command.rebuildIndex {
+		result, err := tinynfs.RebuildIndex(dpath, config.Storage)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("rebuild index: %d volumes, %d records, %d files, %d hashs, %d deleted\n", result.Volumes, result.Records, result.Files, result.Hashs, result.Deleted)
+		for _, v := range result.Skipped {
+			fmt.Println("skipped volume:", v)
+		}
+		for _, v := range result.Missing {
+			fmt.Println("missing data:", v)
+		}
+		for _, v := range result.Conflicts {
+			fmt.Printf("conflict: %s has %d records not newer than the latest %s\n", v.FilePath, v.Count, time.Unix(0, v.Timestamp).Format(time.RFC3339Nano))
+		}
+		if len(result.Backup) > 0 {
+			fmt.Println("old index storage:", result.Backup)
+		}
+		return
+	}
+
+	if command.listSnapshots {
+		snapshots, err := tinynfs.ListSnapshots(dpath)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		for _, v := range snapshots {
+			fmt.Printf("%s\t%d\t%s\n", v.Name, v.Size, time.Unix(0, v.Timestamp).Format(time.RFC3339))
+		}
+		return
+	}
+
+	if len(command.restoreSnapshot) > 0 {
+		result, err := tinynfs.RestoreSnapshot(dpath, config.Storage, command.restoreSnapshot)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		fmt.Printf("restore snapshot: %s, %d files\n", result.Snapshot, result.Files)
+		for _, v := range result.Skipped {
+			fmt.Println("skipped volume:", v)
+		}
+		for _, v := range result.Missing {
+			fmt.Println("missing after snapshot:", v)
+		}
+		for _, v := range result.Resurrected {
+			fmt.Println("deleted after snapshot:", v)
+		}
+		for _, v := range result.Unreachable {
+			fmt.Println("volume removed:", v)
+		}
+		if len(result.Backup) > 0 {
+			fmt.Println("old index storage:", result.Backup)
+		}
+		return
+	}
+
 	storage, err := tinynfs.NewFileSystem(dpath, config.Storage)
 	if err != nil {
 		log.Fatalln(err)
@@ -85,6 +153,12 @@ func main() {
 	go func() {
 		for _ = range ticker.C {
 			storage.Snapshot(false)
+			storage.Compact(false)
+			storage.CleanUploads()
+			storage.CleanExpires()
+			storage.PurgeTrash()
+			// The scrub is slow by the rate limit
+			go storage.Scrub(false)
 		}
 	}()
 	tinynfs.WaitProcessExit(func() {